@@ -62,6 +62,10 @@ type Paging struct {
 	Current int `json:"current"`
 	Total   int `json:"total"`
 	Chunk   int `json:"chunk"`
+
+	// Cursors, when paginating by keyset
+	Next string `json:"next,omitempty"`
+	Prev string `json:"prev,omitempty"`
 }
 
 type ApiPageResponse struct {
@@ -91,6 +95,16 @@ func (a *ApiPageResponse) SetData(d interface{}, current, total int) error {
 	return nil
 }
 
+func (a *ApiPageResponse) SetKeysetData(d interface{}, next, prev string) error {
+	a.Data = d
+	a.Success = true
+
+	a.Next = next
+	a.Prev = prev
+
+	return nil
+}
+
 func NewApiPageResponse(page, chunk int) ApiPageResponse {
 
 	if page <= 0 {
@@ -0,0 +1,448 @@
+package do
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/rightjoin/fig"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+/*
+	ENCRYPTED FIELDS
+
+	type Customer struct {
+		NationalID string `bson:"national_id" json:"national_id" encrypt:"yes;blind"`
+		BankNumber string `bson:"bank_number" json:"bank_number" encrypt:"yes"`
+	}
+
+	String fields tagged encrypt:"yes" are encrypted (AES-GCM) by
+	ModelValidateInputs, so they are stored as
+	enc:<key id>:<base64 of nonce and ciphertext>. Reads (Query,
+	FindByID, forms etc) decrypt them back into the model.
+
+	database.encryption:
+		active: k2                  (key id new values are encrypted with)
+		keys:                       (base64 of 16, 24 or 32 bytes)
+			k1: ...                 (older keys, kept to decrypt with)
+			k2: ...
+		blind_key: ...              (base64, for blind indexes)
+
+	Ciphertexts are random, so encrypted fields can't be queried.
+	With encrypt:"yes;blind" an HMAC of the value is stored too,
+	in <key>_blind (or encrypt:"yes;blind=<key>"), and equality
+	on the field is searched through it (see EncryptedEquals).
+	Unique checks and indexes of the field use it as well, so
+	they need one.
+
+	Ciphertexts and blind indexes are bound to the collection
+	and field path (json keys) they are stored at: they can't
+	be moved to, or compared with, other fields
+*/
+
+const encryptPrefix = "enc:"
+
+type Encryption struct {
+	active string
+	keys   map[string]cipher.AEAD
+	blind  []byte
+}
+
+// Encryption to use, loaded from config unless set
+// with UseEncryption
+var encryption *Encryption = nil
+var encryptionMu sync.Mutex
+
+func UseEncryption(e *Encryption) {
+	encryptionMu.Lock()
+	defer encryptionMu.Unlock()
+	encryption = e
+}
+
+func NewEncryption(active string, keys map[string][]byte, blindKey []byte) (*Encryption, error) {
+	e := Encryption{
+		active: active,
+		keys:   map[string]cipher.AEAD{},
+		blind:  blindKey,
+	}
+	for id, key := range keys {
+		if id == "" || strings.Contains(id, ":") {
+			return nil, fmt.Errorf("invalid encryption key id '%s'", id)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key '%s': %v", id, err)
+		}
+		if e.keys[id], err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := e.keys[active]; !ok {
+		return nil, fmt.Errorf("active encryption key '%s' not found", active)
+	}
+	return &e, nil
+}
+
+func encryptionFromConfig() (*Encryption, error) {
+	if !fig.Exists("database.encryption.keys") {
+		return nil, errors.New("no encryption keys configured")
+	}
+
+	decode := func(key string) ([]byte, error) {
+		b, err := base64.StdEncoding.DecodeString(fig.String(key))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+		return b, nil
+	}
+
+	keys := map[string][]byte{}
+	for id := range fig.Map("database.encryption.keys") {
+		key, err := decode("database.encryption.keys." + id)
+		if err != nil {
+			return nil, err
+		}
+		keys[id] = key
+	}
+	var blind []byte
+	if fig.Exists("database.encryption.blind_key") {
+		var err error
+		if blind, err = decode("database.encryption.blind_key"); err != nil {
+			return nil, err
+		}
+	}
+
+	// Without an active key, the only one there is
+	active := fig.StringOr("", "database.encryption.active")
+	if active == "" && len(keys) == 1 {
+		for id := range keys {
+			active = id
+		}
+	}
+
+	return NewEncryption(active, keys, blind)
+}
+
+func currentEncryption() (*Encryption, error) {
+	encryptionMu.Lock()
+	defer encryptionMu.Unlock()
+
+	if encryption == nil {
+		e, err := encryptionFromConfig()
+		if err != nil {
+			return nil, err
+		}
+		encryption = e
+	}
+	return encryption, nil
+}
+
+// Collection of a model, given it or its type
+func encryptedCollection(modelType interface{}) string {
+	return MongoCollectionName(reflect.New(TypeDereference(TypeOf(modelType))).Interface())
+}
+
+// What ciphertexts and blind indexes are bound to
+func encryptionBinding(coll string, path string) []byte {
+	return []byte(coll + "\x00" + path + "\x00")
+}
+
+// Encrypts with the active key, bound to the collection and
+// field path (so that it can't be moved to another field)
+func (e *Encryption) encrypt(coll string, path string, plain string) (string, error) {
+	aead := e.keys[e.active]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plain), encryptionBinding(coll, path))
+	return encryptPrefix + e.active + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypts with the key the value was encrypted with
+func (e *Encryption) decrypt(coll string, path string, stored string) (string, error) {
+	parts := strings.SplitN(strings.TrimPrefix(stored, encryptPrefix), ":", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("field '%s' is not validly encrypted", path)
+	}
+	aead, ok := e.keys[parts[0]]
+	if !ok {
+		return "", fmt.Errorf("field '%s' encrypted with unknown key '%s'", path, parts[0])
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("field '%s' is not validly encrypted", path)
+	}
+	n := aead.NonceSize()
+	plain, err := aead.Open(nil, sealed[:n], sealed[n:], encryptionBinding(coll, path))
+	if err != nil {
+		return "", fmt.Errorf("field '%s' could not be decrypted: %v", path, err)
+	}
+	return string(plain), nil
+}
+
+// Deterministic (keyed) hash of a value of the field, to
+// search by. Equal values of other fields hash differently
+func (e *Encryption) blindIndex(coll string, path string, plain string) (string, error) {
+	if len(e.blind) == 0 {
+		return "", errors.New("no blind index key configured")
+	}
+	mac := hmac.New(sha256.New, e.blind)
+	mac.Write(encryptionBinding(coll, path))
+	mac.Write([]byte(plain))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+type encryptTag struct {
+	blind string // key of the blind index, if any
+}
+
+func parseEncryptTag(fld reflect.StructField, key string) (encryptTag, bool) {
+	parts := strings.Split(fld.Tag.Get("encrypt"), ";")
+	if p := strings.TrimSpace(parts[0]); p != "yes" && p != "true" {
+		return encryptTag{}, false
+	}
+
+	et := encryptTag{}
+	for _, part := range parts[1:] {
+		part = strings.TrimSpace(part)
+		switch {
+		case part == "blind":
+			et.blind = key + "_blind"
+		case strings.HasPrefix(part, "blind="):
+			et.blind = part[6:]
+		}
+	}
+	return et, true
+}
+
+// Encrypts values of encrypt:"yes" fields (and sets their
+// blind indexes). Runs after all other checks of the inputs
+func encryptFields(modelType interface{}, action int, data Map) []ErrorPlus {
+	errs := []ErrorPlus{}
+	coll := encryptedCollection(modelType)
+
+	encrypt := func(fld reflect.StructField, data Map, keys ...string) []ErrorPlus {
+		fname := keys[len(keys)-1]
+		et, ok := parseEncryptTag(fld, fname)
+		if !ok {
+			return nil
+		}
+		source := strings.Join(keys, ".")
+
+		// Blind indexes are only ever set from the value
+		if et.blind != "" {
+			delete(data, et.blind)
+		}
+		if !data.HasKey(fname) {
+			return nil
+		}
+		if TypeDereference(fld.Type).Kind() != reflect.String {
+			errs = append(errs, ErrorPlus{Message: "only string fields can be encrypted", Source: source})
+			return nil
+		}
+
+		val := data[fname]
+		if val == nil || val == "" {
+			if et.blind != "" && action == DB_UPDATE {
+				data[et.blind] = nil
+			}
+			return nil
+		}
+		plain := fmt.Sprintf("%v", val)
+
+		e, err := currentEncryption()
+		if err == nil {
+			data[fname], err = e.encrypt(coll, source, plain)
+		}
+		if err == nil && et.blind != "" {
+			data[et.blind], err = e.blindIndex(coll, source, plain)
+		}
+		if err != nil {
+			errs = append(errs, ErrorPlus{Message: err.Error(), Source: source})
+		}
+		return nil
+	}
+	StructWalk(modelType, WalkConfig{"json"}, data, encrypt)
+
+	return errs
+}
+
+// Condition matching documents whose encrypted field (json
+// key, e.g. national_id) equals value, through its blind index
+func EncryptedEquals(modelType interface{}, key string, value string) (bson.M, error) {
+	et, ok := encryptedField(modelType, key)
+	if !ok || et.blind == "" {
+		return nil, fmt.Errorf("field '%s' has no blind index", key)
+	}
+	e, err := currentEncryption()
+	if err != nil {
+		return nil, err
+	}
+	hash, err := e.blindIndex(encryptedCollection(modelType), key, value)
+	if err != nil {
+		return nil, err
+	}
+
+	blind := et.blind
+	if i := strings.LastIndex(key, "."); i >= 0 {
+		blind = key[:i+1] + blind
+	}
+	return bson.M{blind: hash}, nil
+}
+
+// Encrypt tag of the field at a json key path, if the
+// field is an encrypted one
+func encryptedField(modelType interface{}, path string) (encryptTag, bool) {
+	if _, isName := modelType.(string); isName {
+		return encryptTag{}, false
+	}
+
+	wc := WalkConfig{"json"}
+	t := TypeDereference(TypeOf(modelType))
+	parts := strings.Split(path, ".")
+	for i, part := range parts {
+		if t.Kind() != reflect.Struct {
+			return encryptTag{}, false
+		}
+		found := false
+		for j := 0; j < t.NumField(); j++ {
+			fld := t.Field(j)
+			if wc.FieldKey(fld) != part {
+				continue
+			}
+			if i == len(parts)-1 {
+				return parseEncryptTag(fld, part)
+			}
+			t = TypeDereference(fld.Type)
+			found = true
+			break
+		}
+		if !found {
+			return encryptTag{}, false
+		}
+	}
+	return encryptTag{}, false
+}
+
+// Does the type have encrypted fields (at any depth)?
+var encryptedTypes sync.Map
+
+func typeEncrypts(t reflect.Type) bool {
+	if v, ok := encryptedTypes.Load(t); ok {
+		return v.(bool)
+	}
+	// Assume none while looking, so recursive types end
+	encryptedTypes.Store(t, false)
+
+	found := false
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		found = typeEncrypts(t.Elem())
+	case reflect.Struct:
+		if TypeIsTime(t) {
+			break
+		}
+		for i := 0; i < t.NumField() && !found; i++ {
+			fld := t.Field(i)
+			if fld.PkgPath != "" && !fld.Anonymous {
+				continue
+			}
+			if _, ok := parseEncryptTag(fld, ""); ok {
+				found = true
+			} else {
+				found = typeEncrypts(fld.Type)
+			}
+		}
+	}
+
+	encryptedTypes.Store(t, found)
+	return found
+}
+
+// Decrypts encrypted fields of what addr points to (a model,
+// a slice of them, ..). Values not encrypted are left as is.
+// They are bound to the collection of the model type
+func decryptFields(addr interface{}) error {
+	v := reflect.ValueOf(addr)
+	if !v.IsValid() || !typeEncrypts(v.Type()) {
+		return nil
+	}
+	e, err := currentEncryption()
+	if err != nil {
+		return err
+	}
+	return e.decryptValue(v, "", nil)
+}
+
+// Decrypts fields of v, a model of collection coll (or a
+// struct nested in one, at the path keys)
+func (e *Encryption) decryptValue(v reflect.Value, coll string, keys []string) error {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return e.decryptValue(v.Elem(), coll, keys)
+	case reflect.Slice, reflect.Array:
+		if !typeEncrypts(v.Type().Elem()) {
+			return nil
+		}
+		for i := 0; i < v.Len(); i++ {
+			if err := e.decryptValue(v.Index(i), coll, keys); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		if !typeEncrypts(v.Type()) {
+			return nil
+		}
+		if coll == "" {
+			coll = encryptedCollection(v.Type())
+		}
+		wc := WalkConfig{"json"}
+		for i := 0; i < v.NumField(); i++ {
+			fld := v.Type().Field(i)
+			if fld.PkgPath != "" && !fld.Anonymous {
+				continue
+			}
+			fv := v.Field(i)
+			key := wc.FieldKey(fld)
+			if _, ok := parseEncryptTag(fld, key); ok {
+				for fv.Kind() == reflect.Ptr && !fv.IsNil() {
+					fv = fv.Elem()
+				}
+				if fv.Kind() != reflect.String || !fv.CanSet() || !strings.HasPrefix(fv.String(), encryptPrefix) {
+					continue
+				}
+				path := strings.Join(append(append([]string{}, keys...), key), ".")
+				plain, err := e.decrypt(coll, path, fv.String())
+				if err != nil {
+					return err
+				}
+				fv.SetString(plain)
+				continue
+			}
+			// Nested structs add to the path (as in StructWalk)
+			sub := keys
+			if ft := TypeDereference(fld.Type); ft.Kind() == reflect.Struct && !TypeIsTime(ft) {
+				sub = append(append([]string{}, keys...), key)
+			}
+			if err := e.decryptValue(fv, coll, sub); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
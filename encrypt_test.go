@@ -0,0 +1,160 @@
+package do
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type encCustomer struct {
+	MongoEntity
+	ID         string `bson:"_id" json:"id" insert:"no" auto:"prefix:c-;alphanum(6)"`
+	Name       string `bson:"name" json:"name"`
+	NationalID string `bson:"national_id" json:"national_id" encrypt:"yes;blind"`
+	Bank       struct {
+		Number string `bson:"number" json:"number" encrypt:"yes"`
+	} `bson:"bank" json:"bank"`
+}
+
+func TestEncryptedFields(t *testing.T) {
+
+	k1 := bytes.Repeat([]byte{1}, 32)
+	k2 := bytes.Repeat([]byte{2}, 32)
+	blind := []byte("blind-index-key")
+
+	e1, err := NewEncryption("k1", map[string][]byte{"k1": k1}, blind)
+	assert.Nil(t, err)
+	UseEncryption(e1)
+	defer UseEncryption(nil)
+
+	_, err = NewEncryption("k3", map[string][]byte{"k1": k1}, blind)
+	assert.NotNil(t, err)
+
+	ms := NewMemoryStore()
+
+	// Stored encrypted, read back in plain
+	c := encCustomer{}
+	errs := ms.InsertForm(&c, Map{"name": "abc", "national_id": "A123", "bank.number": "999"})
+	assert.Equal(t, 0, len(errs))
+	assert.Equal(t, "A123", c.NationalID)
+	assert.Equal(t, "999", c.Bank.Number)
+
+	stored := ms.data["enc_customer"][0]
+	assert.True(t, strings.HasPrefix(stored["national_id"].(string), "enc:k1:"))
+	assert.True(t, strings.HasPrefix(stored["bank"].(bson.M)["number"].(string), "enc:k1:"))
+	assert.Equal(t, 64, len(stored["national_id_blind"].(string)))
+
+	// Searched by equality, through the blind index
+	cond, err := EncryptedEquals(encCustomer{}, "national_id", "A123")
+	assert.Nil(t, err)
+	found := []encCustomer{}
+	_, err = ms.Query(encCustomer{}, &found, QueryOptions{Query: cond})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(found))
+	assert.Equal(t, "999", found[0].Bank.Number)
+
+	_, err = EncryptedEquals(encCustomer{}, "bank.number", "999")
+	assert.NotNil(t, err)
+
+	// Searches by request, which can't be done otherwise
+	// match nothing
+	extract := func(q string) bson.D {
+		req := httptest.NewRequest("GET", "/?"+q, nil)
+		query, _ := ExtractQueryBson(echo.New().NewContext(req, httptest.NewRecorder()), encCustomer{})
+		return query
+	}
+	assert.Equal(t, bson.D{{Key: "national_id_blind", Value: cond["national_id_blind"]}}, extract("national_id=A123"))
+	for _, q := range []string{"national_id:ne=A123", "bank.number=999"} {
+		found = []encCustomer{}
+		_, err = ms.Query(encCustomer{}, &found, QueryOptions{Query: extract(q)})
+		assert.Nil(t, err)
+		assert.Equal(t, 0, len(found))
+	}
+
+	// Rotation: new values use the active key, older
+	// ones still decrypt
+	e2, err := NewEncryption("k2", map[string][]byte{"k1": k1, "k2": k2}, blind)
+	assert.Nil(t, err)
+	UseEncryption(e2)
+
+	errs = ms.UpdateForm(&c, bson.M{"_id": c.ID}, Map{"national_id": "B456"})
+	assert.Equal(t, 0, len(errs))
+	assert.Equal(t, "B456", c.NationalID)
+	assert.Equal(t, "999", c.Bank.Number)
+
+	stored = ms.data["enc_customer"][0]
+	assert.True(t, strings.HasPrefix(stored["national_id"].(string), "enc:k2:"))
+	assert.True(t, strings.HasPrefix(stored["bank"].(bson.M)["number"].(string), "enc:k1:"))
+
+	cond, _ = EncryptedEquals(encCustomer{}, "national_id", "B456")
+	found = []encCustomer{}
+	ms.Query(encCustomer{}, &found, QueryOptions{Query: cond})
+	assert.Equal(t, 1, len(found))
+
+	// Ciphertexts and blind indexes are bound to their
+	// collection and field
+	_, err = e2.decrypt("enc_customer", "national_id", stored["national_id"].(string))
+	assert.Nil(t, err)
+	_, err = e2.decrypt("enc_customer", "name", stored["national_id"].(string))
+	assert.NotNil(t, err)
+	_, err = e2.decrypt("other", "national_id", stored["national_id"].(string))
+	assert.NotNil(t, err)
+
+	b1, _ := e2.blindIndex("enc_customer", "national_id", "B456")
+	b2, _ := e2.blindIndex("enc_customer", "passport", "B456")
+	b3, _ := e2.blindIndex("other", "national_id", "B456")
+	assert.Equal(t, stored["national_id_blind"], b1)
+	assert.NotEqual(t, b1, b2)
+	assert.NotEqual(t, b1, b3)
+
+	// Without the key, values can't be read
+	UseEncryption(e1)
+	found = []encCustomer{}
+	_, err = ms.Query(encCustomer{}, &found)
+	assert.NotNil(t, err)
+}
+
+type encMember struct {
+	MongoEntity
+	ID    string `bson:"_id" json:"id" insert:"no" auto:"prefix:m-;alphanum(6)"`
+	Email string `bson:"email" json:"email" unique:"true" index:"unique" encrypt:"yes;blind"`
+}
+
+type encBadMember struct {
+	MongoEntity
+	ID    string `bson:"_id" json:"id" insert:"no" auto:"prefix:m-;alphanum(6)"`
+	Email string `bson:"email" json:"email" unique:"true" index:"unique" encrypt:"yes"`
+}
+
+func TestEncryptedUnique(t *testing.T) {
+
+	e, err := NewEncryption("k1", map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)}, []byte("blind-index-key"))
+	assert.Nil(t, err)
+	UseEncryption(e)
+	defer UseEncryption(nil)
+
+	// Checked (and indexed) through the blind index
+	ms := NewMemoryStore()
+	errs := ms.InsertForm(&encMember{}, Map{"email": "a@b.com"})
+	assert.Equal(t, 0, len(errs))
+	errs = ms.InsertForm(&encMember{}, Map{"email": "a@b.com"})
+	assert.Equal(t, []ErrorPlus{{Message: msgTaken, Source: "email"}}, errs)
+	errs = ms.InsertForm(&encMember{}, Map{"email": "c@d.com"})
+	assert.Equal(t, 0, len(errs))
+
+	indexes, err := ModelIndexes(encMember{})
+	assert.Nil(t, err)
+	assert.Equal(t, bson.D{{Key: "email_blind", Value: 1}}, indexes[0].Keys)
+
+	// which they need to have
+	errs = ms.InsertForm(&encBadMember{}, Map{"email": "a@b.com"})
+	assert.Equal(t, 1, len(errs))
+	assert.Equal(t, "email", errs[0].Source)
+	_, err = ModelIndexes(encBadMember{})
+	assert.NotNil(t, err)
+}
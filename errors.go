@@ -2,6 +2,11 @@ package do
 
 import "fmt"
 
+var (
+	ErrNotFound = ErrorPlus{Message: "document not found"}
+	ErrConflict = ErrorPlus{Message: "document has been modified since it was read", Source: "version"}
+)
+
 type ErrorPlus struct {
 	Message string `json:"message"`
 	Source  string `json:"source,omitempty"`
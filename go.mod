@@ -2,7 +2,10 @@ module github.com/outerjoin/do
 
 go 1.17
 
-require go.mongodb.org/mongo-driver v1.8.1
+require (
+	github.com/k0kubun/pp v3.0.1+incompatible
+	go.mongodb.org/mongo-driver v1.8.1
+)
 
 require (
 	github.com/go-stack/stack v1.8.0 // indirect
@@ -57,7 +60,6 @@ require (
 )
 
 require (
-	github.com/k0kubun/pp v3.0.1+incompatible // indirect
 	github.com/labstack/gommon v0.3.0 // indirect
 	github.com/mattn/go-colorable v0.1.8 // indirect
 	github.com/mattn/go-isatty v0.0.14 // indirect
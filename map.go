@@ -116,3 +116,22 @@ func (m Map) Clone() Map {
 
 	return output
 }
+
+// Clone, with nested maps cloned too
+func (m Map) DeepClone() Map {
+
+	output := map[string]interface{}{}
+
+	for key, val := range m {
+		switch sub := val.(type) {
+		case Map:
+			output[key] = sub.DeepClone()
+		case map[string]interface{}:
+			output[key] = map[string]interface{}(Map(sub).DeepClone())
+		default:
+			output[key] = val
+		}
+	}
+
+	return output
+}
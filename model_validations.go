@@ -25,6 +25,8 @@ import (
 		email:
 		rex(...)
 		enum(abc|def|ghi)
+	unique: true (checked against DB by InsertForm / UpdateForm)
+	encrypt: yes[;blind] (encrypted after all checks, see encrypt.go)
 	[Recursive: ??]
 */
 
@@ -47,7 +49,7 @@ func correctInitalState(modelType interface{}, action int, data Map) []ErrorPlus
 				Source:  f,
 			})
 		} else {
-			state := data[f].(string)
+			state, _ := data[f].(string)
 			if !data.HasKey(f) {
 				data[f] = sm.DefaultState
 			} else if state == "" {
@@ -148,6 +150,32 @@ func populateTimedFields(modelType interface{}, action int, data Map) []ErrorPlu
 	return errs
 }
 
+func populateVersionField(modelType interface{}, action int, data Map) []ErrorPlus {
+	errs := []ErrorPlus{}
+
+	// Versioned entities start at version 1, and every update
+	// must state the version it was based on
+	if isVersioned(modelType) {
+		switch action {
+		case DB_INSERT:
+			data["version"] = 1
+		case DB_UPDATE:
+			if !data.HasKey("version") {
+				errs = append(errs, ErrorPlus{Message: "field 'version' needs a value upon updation", Source: "version"})
+			} else if str, isStr := data["version"].(string); isStr {
+				version, err := ParseType(str, reflect.TypeOf(0))
+				if err != nil {
+					errs = append(errs, ErrorPlus{Message: err.Error(), Source: "version"})
+				} else {
+					data["version"] = version
+				}
+			}
+		}
+	}
+
+	return errs
+}
+
 func populateAutoFields(modelType interface{}, action int, data Map) []ErrorPlus {
 	errs := []ErrorPlus{}
 	isMongoEntity := TypeComposedOf(modelType, MongoEntity{})
@@ -291,6 +319,7 @@ func ModelValidateInputs(modelType interface{}, action int, data Map) []ErrorPlu
 		errs = append(errs, provideDefualts(modelType, action, data)...)
 		errs = append(errs, trimFields(modelType, action, data)...)
 		errs = append(errs, populateTimedFields(modelType, action, data)...)
+		errs = append(errs, populateVersionField(modelType, action, data)...)
 		errs = append(errs, populateAutoFields(modelType, action, data)...)
 		errs = append(errs, correctInitalState(modelType, action, data)...)
 		{
@@ -300,6 +329,8 @@ func ModelValidateInputs(modelType interface{}, action int, data Map) []ErrorPlu
 		// Post field type conversion - do verification and custom checks
 		errs = append(errs, verifyInputs(modelType, action, data)...)
 		errs = append(errs, customInsertUpdateChecks(modelType, action, data)...)
+		// Lastly, so that checks above see plain values
+		errs = append(errs, encryptFields(modelType, action, data)...)
 	}
 
 	pp.Println("ModelValidateInputs@", data)
@@ -460,3 +491,29 @@ func ModelValidateObject(object interface{}) []ErrorPlus {
 
 	return errs
 }
+
+// - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
+
+// Runs checks on an object (as read from DB) before
+// it gets deleted
+func ModelValidateDelete(object interface{}) []ErrorPlus {
+	errs := []ErrorPlus{}
+
+	if del, ok := object.(DBDeletable); ok {
+		errs = append(errs, del.BeforeDelete(object)...)
+	}
+
+	return errs
+}
+
+// Runs checks on an object after it has been deleted
+// from DB, but before the transaction is committed
+func ModelValidateDeleted(object interface{}) []ErrorPlus {
+	errs := []ErrorPlus{}
+
+	if del, ok := object.(DBDeleted); ok {
+		errs = append(errs, del.AfterDelete(object)...)
+	}
+
+	return errs
+}
@@ -345,3 +345,67 @@ func TestTrim(t *testing.T) {
 	assert.Equal(t, " 1 ", m["field1"])
 	assert.Equal(t, "2", m["field2"])
 }
+
+type deleteGuarded struct {
+	MongoEntity
+	Locked bool `bson:"locked" json:"locked"`
+}
+
+func (d *deleteGuarded) BeforeDelete(object interface{}) []ErrorPlus {
+	if object.(*deleteGuarded).Locked {
+		return []ErrorPlus{{Message: "locked records cannot be deleted", Source: "locked"}}
+	}
+	return nil
+}
+
+func TestValidateDelete(t *testing.T) {
+
+	// BeforeDelete gets to veto the deletion
+	{
+		errs := ModelValidateDelete(&deleteGuarded{Locked: true})
+		assert.Equal(t, 1, len(errs))
+		assert.Equal(t, "locked", errs[0].Source)
+	}
+
+	{
+		errs := ModelValidateDelete(&deleteGuarded{Locked: false})
+		assert.Equal(t, 0, len(errs))
+	}
+
+	// Models without the hook pass through
+	{
+		errs := ModelValidateDelete(&struct{ MongoEntity }{})
+		assert.Equal(t, 0, len(errs))
+	}
+}
+
+func TestVersionField(t *testing.T) {
+
+	a := struct {
+		MongoEntity
+		Versioned `bson:"inline"`
+	}{}
+
+	// Inserts start at version 1
+	{
+		m := map[string]interface{}{}
+		errs := populateVersionField(a, DB_INSERT, m)
+		assert.Equal(t, 0, len(errs))
+		assert.Equal(t, 1, m["version"])
+	}
+
+	// Updates must state the version
+	{
+		errs := populateVersionField(a, DB_UPDATE, map[string]interface{}{})
+		assert.Equal(t, 1, len(errs))
+		assert.Equal(t, "version", errs[0].Source)
+	}
+
+	// which gets converted from form input
+	{
+		m := map[string]interface{}{"version": "7"}
+		errs := populateVersionField(a, DB_UPDATE, m)
+		assert.Equal(t, 0, len(errs))
+		assert.Equal(t, 7, m["version"])
+	}
+}
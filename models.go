@@ -1,9 +1,12 @@
 package do
 
 import (
+	"encoding/json"
 	"fmt"
 	"reflect"
 	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
 )
 
 const (
@@ -31,11 +34,64 @@ type DBSerialize interface {
 	AfterSave(object interface{}) []ErrorPlus
 }
 
+type DBDeletable interface {
+	BeforeDelete(object interface{}) []ErrorPlus
+}
+
+type DBDeleted interface {
+	AfterDelete(object interface{}) []ErrorPlus
+}
+
 type Timed struct {
 	CreatedAt time.Time `bson:"created_at" json:"created_at" index:"true"`
 	UpdatedAt time.Time `bson:"updated_at" json:"updated_at" index:"true"`
 }
 
+// Embedding SoftDeleted in a MongoEntity makes deletes
+// stamp deleted_at (and deleted_by) instead of removing
+// the document. Such documents are left out of queries
+// unless asked for explicitly.
+type SoftDeleted struct {
+	DeletedAt *time.Time `bson:"deleted_at" json:"deleted_at" index:"true"`
+	DeletedBy string     `bson:"deleted_by" json:"deleted_by"`
+}
+
+func isSoftDeletable(model interface{}) bool {
+	if _, ok := model.(string); ok {
+		return false
+	}
+	return TypeComposedOf(model, MongoEntity{}) && TypeComposedOf(model, SoftDeleted{})
+}
+
+// Given a query, returns a query that additionally leaves
+// out soft deleted documents (if the model supports it)
+func excludeSoftDeleted(model interface{}, query interface{}) interface{} {
+	if !isSoftDeletable(model) {
+		return query
+	}
+
+	notDeleted := bson.M{"deleted_at": nil}
+	if query == nil {
+		return notDeleted
+	}
+
+	return bson.M{"$and": bson.A{query, notDeleted}}
+}
+
+// Embedding Versioned in a MongoEntity enables optimistic
+// concurrency: updates must carry the version they were
+// based on, and fail with ErrConflict if it is stale
+type Versioned struct {
+	Version int `bson:"version" json:"version" insert:"no"`
+}
+
+func isVersioned(model interface{}) bool {
+	if _, ok := model.(string); ok {
+		return false
+	}
+	return TypeComposedOf(model, MongoEntity{}) && TypeComposedOf(model, Versioned{})
+}
+
 type StateMachine struct {
 	MongoEntity
 
@@ -129,6 +185,55 @@ func (sm StateMachine) GetStateMachineFieldNames(obj interface{}) []string {
 	return output
 }
 
+// Values of the given state machine fields of an object
+func stateMachineValues(addrObject interface{}, fields []string) (map[string]string, error) {
+	output := map[string]string{}
+
+	// Object to []byte
+	b, err := json.Marshal(reflect.ValueOf(addrObject).Elem().Interface())
+	if err != nil {
+		return nil, err
+	}
+
+	// []byte to map
+	var objMap map[string]interface{}
+	err = json.Unmarshal(b, &objMap)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range fields {
+		if val, ok := objMap[f]; ok {
+			output[f], _ = val.(string)
+		}
+	}
+
+	return output, nil
+}
+
+// See which state machine field has chagned (from the
+// pre values), and if its a valid transition
+func checkStateTransitions(coll string, fields []string, pre map[string]string, addrObject interface{}) error {
+
+	post, err := stateMachineValues(addrObject, fields)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range fields {
+		if to, ok := post[f]; ok && to != pre[f] {
+			sm := getStateMachine(coll, f)
+			if sm == nil {
+				return fmt.Errorf("no state machine found %s.%s", coll, f)
+			} else if !sm.CanMove(pre[f], to) {
+				return fmt.Errorf("invalid state transition (%s) from %s to %s", f, pre[f], to)
+			}
+		}
+	}
+
+	return nil
+}
+
 type StateMachineMovement struct {
 	From string `bson:"from" json:"from"`
 	To   string `bson:"to" json:"to"`
@@ -136,6 +241,15 @@ type StateMachineMovement struct {
 
 var allMachines []StateMachine = nil
 
+// Store that state machines are read from. Defaults to
+// MongoDB (as configured), tests may use a MemoryStore
+var machineStore Store = nil
+
+func UseStateMachineStore(s Store) {
+	machineStore = s
+	allMachines = nil
+}
+
 func getStateMachine(entity, field string) *StateMachine {
 
 	read := StateMachine{}
@@ -143,12 +257,16 @@ func getStateMachine(entity, field string) *StateMachine {
 	var ref interface{} = &records
 
 	if allMachines == nil {
-		// Mongo connection
-		mo := NewMongoConnect()
-		defer mo.CloseClient()
+		store := machineStore
+		if store == nil {
+			// Mongo connection
+			mo := NewMongoConnect()
+			defer mo.CloseClient()
+			store = mo
+		}
 
 		// Fetch
-		_, err := mo.Query(read, ref)
+		_, err := store.Query(read, ref)
 		if err != nil {
 			// TODO:
 			// log error
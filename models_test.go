@@ -0,0 +1,33 @@
+package do
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestExcludeSoftDeleted(t *testing.T) {
+
+	type plain struct {
+		MongoEntity
+	}
+	type soft struct {
+		MongoEntity
+		SoftDeleted `bson:"inline"`
+	}
+
+	// Models without SoftDeleted keep query as is
+	{
+		q := bson.M{"name": "abc"}
+		assert.Equal(t, q, excludeSoftDeleted(plain{}, q))
+		assert.Equal(t, q, excludeSoftDeleted("some_collection", q))
+	}
+
+	// Otherwise deleted documents are filtered out
+	{
+		q := bson.M{"name": "abc"}
+		assert.Equal(t, bson.M{"$and": bson.A{q, bson.M{"deleted_at": nil}}}, excludeSoftDeleted(&soft{}, q))
+		assert.Equal(t, bson.M{"deleted_at": nil}, excludeSoftDeleted(soft{}, nil))
+	}
+}
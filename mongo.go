@@ -5,6 +5,10 @@ import (
 	"strings"
 
 	"github.com/rightjoin/rutl/conv"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
 )
 
 // Given a struct, or address of a struct, get the
@@ -30,3 +34,77 @@ func MongoCollectionName(model interface{}) string {
 
 	return strings.TrimSpace(conv.CaseSnake(t.Name()))
 }
+
+// Given a struct, or address of a struct, get the named
+// connection (see NewMongoConnectNamed) it is stored in, as
+// returned by its MongoConnection method. Empty means default
+func MongoConnectionName(model interface{}) string {
+	if _, ok := model.(string); ok {
+		return ""
+	}
+
+	// Indirect
+	t := reflect.TypeOf(model)
+	v := reflect.ValueOf(model)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+		v = v.Elem()
+	}
+
+	// If "MongoConnection" method exists, call it
+	if _, ok := t.MethodByName("MongoConnection"); ok {
+		out := v.MethodByName("MongoConnection").Call([]reflect.Value{})
+		return out[0].String()
+	}
+
+	return ""
+}
+
+// Options a model may declare (using a MongoOptions method)
+// for the collection it is stored in
+type MongoModelOptions struct {
+	ReadPreference *readpref.ReadPref
+	ReadConcern    *readconcern.ReadConcern
+	WriteConcern   *writeconcern.WriteConcern
+	Collation      *options.Collation
+}
+
+// Given a struct, or address of a struct, get the options
+// it declares for its collection (nil if none)
+func MongoOptions(model interface{}) *MongoModelOptions {
+	if _, ok := model.(string); ok {
+		return nil
+	}
+
+	// Indirect
+	t := reflect.TypeOf(model)
+	v := reflect.ValueOf(model)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+		v = v.Elem()
+	}
+
+	// If "MongoOptions" method exists, call it
+	if _, ok := t.MethodByName("MongoOptions"); ok {
+		out := v.MethodByName("MongoOptions").Call([]reflect.Value{})
+		if opts, ok := out[0].Interface().(MongoModelOptions); ok {
+			return &opts
+		}
+	}
+
+	return nil
+}
+
+func (mo *MongoModelOptions) collectionOptions() *options.CollectionOptions {
+	opts := options.Collection()
+	if mo.ReadPreference != nil {
+		opts.SetReadPreference(mo.ReadPreference)
+	}
+	if mo.ReadConcern != nil {
+		opts.SetReadConcern(mo.ReadConcern)
+	}
+	if mo.WriteConcern != nil {
+		opts.SetWriteConcern(mo.WriteConcern)
+	}
+	return opts
+}
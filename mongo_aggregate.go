@@ -0,0 +1,351 @@
+package do
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+/*
+	AGGREGATION
+
+	mc.Aggregate(Order{}).
+		Match(bson.M{"status": "paid"}).
+		Group("$customer_id", bson.M{"total": bson.M{"$sum": "$amount"}}).
+		Sort(bson.D{{"total", -1}}).
+		Into(&rows)
+
+	Field paths are checked against the model, as long as the
+	documents still have the model's shape. Stages that reshape
+	documents (group, project, facet) end the checks; fields
+	added by lookup are known from then on.
+
+	Soft deleted documents of the model are left out (by a
+	leading $match), unless WithDeleted is called
+*/
+
+type Aggregation struct {
+	mc     *MongoConnect
+	model  interface{}
+	stages mongo.Pipeline
+	errs   []ErrorPlus
+
+	// Once reshaped, fields can't be checked against the model
+	reshaped bool
+	added    map[string]bool
+
+	withDeleted bool
+}
+
+func (mc *MongoConnect) Aggregate(model interface{}) *Aggregation {
+	return &Aggregation{
+		mc:     mc.forModel(model),
+		model:  model,
+		stages: mongo.Pipeline{},
+		errs:   []ErrorPlus{},
+		added:  map[string]bool{},
+	}
+}
+
+// Includes documents that have been soft deleted
+func (a *Aggregation) WithDeleted() *Aggregation {
+	a.withDeleted = true
+	return a
+}
+
+func (a *Aggregation) Match(filter interface{}) *Aggregation {
+	for _, k := range aggregateKeys(filter) {
+		a.checkField("$match", k)
+	}
+	return a.stage("$match", filter)
+}
+
+// Groups by id (e.g. "$field" or bson.M{"a": "$a"}), with
+// accumulators keyed by output field
+func (a *Aggregation) Group(id interface{}, accumulators interface{}) *Aggregation {
+	a.checkRefs("$group", id)
+	a.checkRefs("$group", accumulators)
+
+	group := bson.D{{Key: "_id", Value: id}}
+	for _, k := range aggregateKeys(accumulators) {
+		group = append(group, bson.E{Key: k, Value: aggregateValue(accumulators, k)})
+	}
+
+	a.stage("$group", group)
+	a.reshaped = true
+	return a
+}
+
+func (a *Aggregation) Project(projection interface{}) *Aggregation {
+	for _, k := range aggregateKeys(projection) {
+		v := aggregateValue(projection, k)
+		switch v.(type) {
+		case int, int32, int64, bool:
+			// inclusion / exclusion of an existing field
+			a.checkField("$project", k)
+		default:
+			a.checkRefs("$project", v)
+		}
+	}
+
+	a.stage("$project", projection)
+	a.reshaped = true
+	return a
+}
+
+// Joins documents of another model (or collection name) where
+// localField equals foreignField, into array field 'as'
+func (a *Aggregation) Lookup(from interface{}, localField, foreignField, as string) *Aggregation {
+	a.checkField("$lookup", localField)
+	if _, isName := from.(string); !isName && !aggregateFieldKnown(from, foreignField) {
+		a.errs = append(a.errs, ErrorPlus{
+			Message: fmt.Sprintf("unknown field '%s' of %s", foreignField, MongoCollectionName(from)),
+			Source:  "$lookup",
+		})
+	}
+
+	a.added[as] = true
+	return a.stage("$lookup", bson.D{
+		{Key: "from", Value: a.mc.CollectionName(from)},
+		{Key: "localField", Value: localField},
+		{Key: "foreignField", Value: foreignField},
+		{Key: "as", Value: as},
+	})
+}
+
+func (a *Aggregation) Unwind(path string) *Aggregation {
+	path = strings.TrimPrefix(path, "$")
+	a.checkField("$unwind", path)
+	return a.stage("$unwind", "$"+path)
+}
+
+func (a *Aggregation) Sort(sort bson.D) *Aggregation {
+	for _, e := range sort {
+		a.checkField("$sort", e.Key)
+	}
+	return a.stage("$sort", sort)
+}
+
+func (a *Aggregation) Skip(n int) *Aggregation {
+	return a.stage("$skip", n)
+}
+
+func (a *Aggregation) Limit(n int) *Aggregation {
+	return a.stage("$limit", n)
+}
+
+// Runs many sub pipelines (built with mc.Aggregate on the
+// same model) over the same documents
+func (a *Aggregation) Facet(facets map[string]*Aggregation) *Aggregation {
+	names := make([]string, 0, len(facets))
+	for name := range facets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	facet := bson.D{}
+	for _, name := range names {
+		sub := facets[name]
+		for _, e := range sub.errs {
+			a.errs = append(a.errs, ErrorPlus{Message: e.Message, Source: "$facet." + name + "." + e.Source})
+		}
+		facet = append(facet, bson.E{Key: name, Value: sub.stages})
+	}
+
+	a.stage("$facet", facet)
+	a.reshaped = true
+	return a
+}
+
+// Any other stage, unchecked
+func (a *Aggregation) Stage(name string, value interface{}) *Aggregation {
+	return a.stage(name, value)
+}
+
+func (a *Aggregation) Pipeline() mongo.Pipeline {
+	if a.withDeleted || !isSoftDeletable(a.model) {
+		return a.stages
+	}
+	notDeleted := bson.D{{Key: "$match", Value: excludeSoftDeleted(a.model, nil)}}
+	return append(mongo.Pipeline{notDeleted}, a.stages...)
+}
+
+func (a *Aggregation) Errors() []ErrorPlus {
+	return a.errs
+}
+
+func (a *Aggregation) Into(addrSlice interface{}) error {
+	return a.IntoCtx(context.Background(), addrSlice)
+}
+
+// Runs the pipeline and decodes the results into the slice
+// pointed to by addrSlice
+func (a *Aggregation) IntoCtx(ctx context.Context, addrSlice interface{}) error {
+
+	if len(a.errs) > 0 {
+		return a.errs[0]
+	}
+
+	ctx, cancel := a.mc.timeout(ctx, "query")
+	defer cancel()
+
+	cursor, err := a.mc.Collection(a.model).Aggregate(ctx, a.Pipeline())
+	if err != nil {
+		return err
+	}
+
+	if err = cursor.All(ctx, addrSlice); err != nil {
+		return err
+	}
+	return decryptFields(addrSlice)
+}
+
+func (a *Aggregation) stage(name string, value interface{}) *Aggregation {
+	a.stages = append(a.stages, bson.D{{Key: name, Value: value}})
+	return a
+}
+
+func (a *Aggregation) checkField(stage string, path string) {
+	if a.reshaped || strings.HasPrefix(path, "$") || path == "_id" {
+		return
+	}
+	if a.added[strings.Split(path, ".")[0]] {
+		return
+	}
+	if _, isName := a.model.(string); isName {
+		return
+	}
+	if !aggregateFieldKnown(a.model, path) {
+		a.errs = append(a.errs, ErrorPlus{
+			Message: fmt.Sprintf("unknown field '%s' of %s", path, MongoCollectionName(a.model)),
+			Source:  stage,
+		})
+	}
+}
+
+// Checks field references ("$field") found anywhere in an
+// expression
+func (a *Aggregation) checkRefs(stage string, expr interface{}) {
+	switch e := expr.(type) {
+	case string:
+		if strings.HasPrefix(e, "$") && !strings.HasPrefix(e, "$$") {
+			a.checkField(stage, e[1:])
+		}
+	case bson.D:
+		for _, el := range e {
+			a.checkRefs(stage, el.Value)
+		}
+	case bson.M:
+		for _, v := range e {
+			a.checkRefs(stage, v)
+		}
+	case map[string]interface{}:
+		for _, v := range e {
+			a.checkRefs(stage, v)
+		}
+	case bson.A:
+		for _, v := range e {
+			a.checkRefs(stage, v)
+		}
+	case []interface{}:
+		for _, v := range e {
+			a.checkRefs(stage, v)
+		}
+	}
+}
+
+// Keys of a document, in order for bson.D (sorted otherwise)
+func aggregateKeys(doc interface{}) []string {
+	keys := []string{}
+	switch d := doc.(type) {
+	case bson.D:
+		for _, e := range d {
+			keys = append(keys, e.Key)
+		}
+		return keys
+	case bson.M:
+		for k := range d {
+			keys = append(keys, k)
+		}
+	case map[string]interface{}:
+		for k := range d {
+			keys = append(keys, k)
+		}
+	case Map:
+		for k := range d {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func aggregateValue(doc interface{}, key string) interface{} {
+	switch d := doc.(type) {
+	case bson.D:
+		for _, e := range d {
+			if e.Key == key {
+				return e.Value
+			}
+		}
+	case bson.M:
+		return d[key]
+	case map[string]interface{}:
+		return d[key]
+	case Map:
+		return d[key]
+	}
+	return nil
+}
+
+// Is path (json keys, dot separated) a field of model? Leaf
+// fields are found with StructGetFieldTypeByJsonKey, while
+// nested documents and arrays are walked
+func aggregateFieldKnown(model interface{}, path string) bool {
+	mt := TypeDereference(TypeOf(model))
+	if path == "_id" {
+		return true
+	}
+	if _, found := StructGetFieldTypeByJsonKey(mt, path); found {
+		return true
+	}
+
+	t := mt
+	for _, part := range strings.Split(path, ".") {
+		for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct || TypeIsTime(t) {
+			return false
+		}
+		fld, found := aggregateFieldByKey(t, part)
+		if !found {
+			return false
+		}
+		t = fld.Type
+	}
+
+	return true
+}
+
+func aggregateFieldByKey(t reflect.Type, key string) (reflect.StructField, bool) {
+	wc := WalkConfig{"json"}
+	for i := 0; i < t.NumField(); i++ {
+		fld := t.Field(i)
+		if fld.Anonymous && fld.Tag.Get("json") == "" && TypeDereference(fld.Type).Kind() == reflect.Struct {
+			if sub, found := aggregateFieldByKey(TypeDereference(fld.Type), key); found {
+				return sub, true
+			}
+			continue
+		}
+		if wc.FieldKey(fld) == key {
+			return fld, true
+		}
+	}
+	return reflect.StructField{}, false
+}
@@ -0,0 +1,75 @@
+package do
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type aggOrder struct {
+	MongoEntity
+	CustomerID string `bson:"customer_id" json:"customer_id"`
+	Status     string `bson:"status" json:"status"`
+	Amount     int    `bson:"amount" json:"amount"`
+	Items      []struct {
+		Sku string `bson:"sku" json:"sku"`
+	} `bson:"items" json:"items"`
+	Timed `bson:"inline"`
+}
+
+func TestAggregationFieldChecks(t *testing.T) {
+
+	mc := &MongoConnect{DB: "test"}
+
+	// Known fields pass, including nested array fields
+	// and those of embedded behaviours
+	{
+		a := mc.Aggregate(aggOrder{}).
+			Match(bson.M{"status": "paid", "created_at": bson.M{"$gt": 0}}).
+			Unwind("$items").
+			Sort(bson.D{{Key: "items.sku", Value: 1}}).
+			Group("$customer_id", bson.M{"total": bson.M{"$sum": "$amount"}}).
+			Sort(bson.D{{Key: "total", Value: -1}})
+		assert.Equal(t, 0, len(a.Errors()))
+		assert.Equal(t, 5, len(a.Pipeline()))
+	}
+
+	// Unknown fields are reported
+	{
+		a := mc.Aggregate(aggOrder{}).
+			Match(bson.M{"state": "paid"}).
+			Group("$customer", bson.M{"total": bson.M{"$sum": "$amount"}})
+		assert.Equal(t, 2, len(a.Errors()))
+		assert.Equal(t, "$match", a.Errors()[0].Source)
+		assert.Equal(t, "$group", a.Errors()[1].Source)
+	}
+
+	// Fields added by lookup are known thereafter
+	{
+		a := mc.Aggregate(aggOrder{}).
+			Lookup("customer", "customer_id", "_id", "customer").
+			Unwind("customer").
+			Match(bson.M{"customer.name": "abc"})
+		assert.Equal(t, 0, len(a.Errors()))
+	}
+}
+
+type aggNote struct {
+	MongoEntity
+	Text        string `bson:"text" json:"text"`
+	SoftDeleted `bson:"inline"`
+}
+
+func TestAggregationSoftDeleted(t *testing.T) {
+
+	mc := &MongoConnect{DB: "test"}
+
+	// Soft deleted documents are left out first
+	p := mc.Aggregate(aggNote{}).Match(bson.M{"text": "a"}).Pipeline()
+	assert.Equal(t, 2, len(p))
+	assert.Equal(t, bson.D{{Key: "$match", Value: bson.M{"deleted_at": nil}}}, p[0])
+
+	assert.Equal(t, 1, len(mc.Aggregate(aggNote{}).WithDeleted().Match(bson.M{"text": "a"}).Pipeline()))
+	assert.Equal(t, 1, len(mc.Aggregate(aggOrder{}).Match(bson.M{"status": "paid"}).Pipeline()))
+}
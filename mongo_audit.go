@@ -0,0 +1,200 @@
+package do
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Embedding Audited in a MongoEntity records every insert,
+// update, delete and restore (with a field level diff) in the
+// <collection>_audit collection, in the same transaction
+type Audited struct{}
+
+type AuditRecord struct {
+	ID        string        `bson:"_id" json:"id"`
+	EntityID  interface{}   `bson:"entity_id" json:"entity_id"`
+	Operation string        `bson:"operation" json:"operation"`
+	Actor     string        `bson:"actor" json:"actor"`
+	At        time.Time     `bson:"at" json:"at"`
+	Changes   []AuditChange `bson:"changes" json:"changes"`
+}
+
+type AuditChange struct {
+	Field  string      `bson:"field" json:"field"`
+	Before interface{} `bson:"before" json:"before"`
+	After  interface{} `bson:"after" json:"after"`
+}
+
+type auditActorKey struct{}
+
+// Returns a context that carries the actor (user id, service
+// name etc) to be recorded against audited changes
+func WithAuditActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, auditActorKey{}, actor)
+}
+
+func AuditActor(ctx context.Context) string {
+	if actor, ok := ctx.Value(auditActorKey{}).(string); ok {
+		return actor
+	}
+	return ""
+}
+
+func isAudited(model interface{}) bool {
+	if _, ok := model.(string); ok {
+		return false
+	}
+	return TypeComposedOf(model, MongoEntity{}) && TypeComposedOf(model, Audited{})
+}
+
+func auditCollectionName(model interface{}) string {
+	return MongoCollectionName(model) + "_audit"
+}
+
+// Reads the document (as stored) for diffing. A missing
+// document gives nil
+func (mc *MongoConnect) auditSnapshot(ctx context.Context, model interface{}, query interface{}) (bson.M, error) {
+	doc := bson.M{}
+	err := mc.Collection(model).FindOne(ctx, query, options.FindOne().SetCollation(queryCollation(model, QueryOptions{}))).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	return doc, err
+}
+
+// Reads all documents matching query (as stored), keyed by
+// refKey of their ids
+func (mc *MongoConnect) auditSnapshots(ctx context.Context, model interface{}, query interface{}) (map[string]bson.M, error) {
+	cursor, err := mc.Collection(model).Find(ctx, query, options.Find().SetCollation(queryCollation(model, QueryOptions{})))
+	if err != nil {
+		return nil, err
+	}
+	docs := []bson.M{}
+	if err = cursor.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+
+	output := map[string]bson.M{}
+	for _, doc := range docs {
+		output[refKey(doc["_id"])] = doc
+	}
+	return output, nil
+}
+
+func (mc *MongoConnect) audit(ctx context.Context, model interface{}, operation string, before, after bson.M) error {
+	_, err := mc.Collection(auditCollectionName(model)).InsertOne(ctx, newAuditRecord(ctx, operation, before, after))
+	return err
+}
+
+// Audits the documents with given ids as inserted
+func (mc *MongoConnect) auditInserted(ctx context.Context, model interface{}, ids []interface{}) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	docs, err := mc.auditSnapshots(ctx, model, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if doc, ok := docs[refKey(id)]; ok {
+			if err = mc.audit(ctx, model, "insert", nil, doc); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func newAuditRecord(ctx context.Context, operation string, before, after bson.M) AuditRecord {
+
+	record := AuditRecord{
+		ID:        NewUUID(),
+		Operation: operation,
+		Actor:     AuditActor(ctx),
+		At:        time.Now(),
+		Changes:   auditDiff(before, after),
+	}
+	if after != nil {
+		record.EntityID = after["_id"]
+	} else if before != nil {
+		record.EntityID = before["_id"]
+	}
+	return record
+}
+
+// Field level differences between two documents. Nested
+// documents are compared field by field (a.b.c)
+func auditDiff(before, after bson.M) []AuditChange {
+	b := map[string]interface{}{}
+	a := map[string]interface{}{}
+	auditFlatten("", before, b)
+	auditFlatten("", after, a)
+
+	fields := map[string]bool{}
+	for k := range b {
+		fields[k] = true
+	}
+	for k := range a {
+		fields[k] = true
+	}
+
+	output := []AuditChange{}
+	for f := range fields {
+		if !reflect.DeepEqual(b[f], a[f]) {
+			output = append(output, AuditChange{Field: f, Before: b[f], After: a[f]})
+		}
+	}
+	sort.Slice(output, func(i, j int) bool {
+		return output[i].Field < output[j].Field
+	})
+
+	return output
+}
+
+func auditFlatten(prefix string, doc bson.M, dest map[string]interface{}) {
+	for k, v := range doc {
+		key := k
+		if prefix != "" {
+			key = prefix + "." + k
+		}
+		switch sub := v.(type) {
+		case bson.M:
+			auditFlatten(key, sub, dest)
+		case map[string]interface{}:
+			auditFlatten(key, bson.M(sub), dest)
+		default:
+			dest[key] = v
+		}
+	}
+}
+
+// Returns the audit trail of an entity, oldest first
+func (mc *MongoConnect) AuditHistory(model interface{}, entityID interface{}) ([]AuditRecord, error) {
+	return mc.AuditHistoryCtx(context.Background(), model, entityID)
+}
+
+func (mc *MongoConnect) AuditHistoryCtx(ctx context.Context, model interface{}, entityID interface{}) ([]AuditRecord, error) {
+
+	mc = mc.forModel(model)
+
+	ctx, cancel := mc.timeout(ctx, "query")
+	defer cancel()
+
+	cursor, err := mc.Collection(auditCollectionName(model)).Find(ctx,
+		bson.M{"entity_id": entityID},
+		options.Find().SetSort(bson.D{{Key: "at", Value: 1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	records := []AuditRecord{}
+	err = cursor.All(ctx, &records)
+	return records, err
+}
@@ -0,0 +1,66 @@
+package do
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestAuditDiff(t *testing.T) {
+
+	before := bson.M{"_id": "a1", "name": "abc", "address": bson.M{"city": "pune", "pin": 1}}
+	after := bson.M{"_id": "a1", "name": "abc", "address": bson.M{"city": "delhi", "pin": 1}, "age": 5}
+
+	assert.Equal(t, []AuditChange{
+		{Field: "address.city", Before: "pune", After: "delhi"},
+		{Field: "age", Before: nil, After: 5},
+	}, auditDiff(before, after))
+
+	// Inserts have everything as changed
+	assert.Equal(t, 2, len(auditDiff(nil, bson.M{"_id": "a1", "name": "abc"})))
+}
+
+type audPost struct {
+	MongoEntity
+	Audited
+	ID    string `bson:"_id" json:"id" insert:"no" auto:"prefix:p-;alphanum(6)"`
+	Title string `bson:"title" json:"title"`
+}
+
+type audNote struct {
+	MongoEntity
+	Audited
+	ID     string `bson:"_id" json:"id" insert:"no" auto:"prefix:n-;alphanum(6)"`
+	PostID string `bson:"post_id" json:"post_id" ref:"aud_post;delete=set_null"`
+}
+
+func TestAuditTrail(t *testing.T) {
+
+	defer func() { allModels = map[string]interface{}{} }()
+	allModels = map[string]interface{}{}
+	RegisterModel(audPost{}, audNote{})
+
+	ms := NewMemoryStore()
+	p := audPost{}
+	assert.Equal(t, 0, len(ms.InsertForm(&p, Map{"title": "a"})))
+	assert.Equal(t, 0, len(ms.UpdateForm(&audPost{}, bson.M{"_id": p.ID}, Map{"title": "b"})))
+	assert.Equal(t, 0, len(ms.InsertForm(&audNote{}, Map{"post_id": p.ID})))
+
+	// Referrers set to null get their own records
+	assert.Equal(t, 0, len(ms.DeleteForm(&audPost{}, bson.M{"_id": p.ID})))
+
+	ops := func(coll string) []string {
+		output := []string{}
+		for _, r := range ms.data[coll] {
+			output = append(output, r["operation"].(string))
+		}
+		return output
+	}
+	assert.Equal(t, []string{"insert", "update", "delete"}, ops("aud_post_audit"))
+	assert.Equal(t, []string{"insert", "update"}, ops("aud_note_audit"))
+
+	changes := ms.data["aud_note_audit"][1]["changes"].(bson.A)
+	assert.Equal(t, "post_id", changes[0].(bson.M)["field"])
+	assert.Nil(t, changes[0].(bson.M)["after"])
+}
@@ -0,0 +1,307 @@
+package do
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type InsertFormsOptions struct {
+	// Unordered writes let the DB carry on past a failed
+	// row (and possibly insert faster)
+	Unordered bool
+
+	// By default, a single invalid row fails the whole batch
+	// and nothing is inserted. With BestEffort the valid rows
+	// get inserted (always unordered), and errors are returned
+	// for the rest. No transaction is used then: rows failing
+	// AfterSave checks are deleted again
+	BestEffort bool
+}
+
+func (mc *MongoConnect) InsertForms(model interface{}, rows []Map, opts ...InsertFormsOptions) []ErrorPlus {
+	return mc.InsertFormsCtx(context.Background(), model, rows, opts...)
+}
+
+// Inserts many rows in one go. Source of every error is
+// prefixed with the index of the row, e.g. [42].email
+func (mc *MongoConnect) InsertFormsCtx(ctx context.Context, model interface{}, rows []Map, opts ...InsertFormsOptions) []ErrorPlus {
+
+	mc = mc.forModel(model)
+
+	opt := InsertFormsOptions{}
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+
+	// Validate every row, and remember where each valid
+	// row came from
+	errs := []ErrorPlus{}
+	docs := []interface{}{}
+	origin := []int{}
+	count := bulkUniqueCounter(mc.uniqueCounter(ctx, model), &docs)
+	for i, row := range rows {
+		rowErrs := ModelValidateInputs(model, DB_INSERT, row)
+		if len(rowErrs) == 0 {
+			taken, err := uniqueErrors(model, row, nil, count)
+			if err != nil {
+				return append(errs, ErrorPlus{Message: err.Error()})
+			}
+			rowErrs = taken
+		}
+		if len(rowErrs) > 0 {
+			errs = append(errs, rowErrorPlus(i, rowErrs...)...)
+			continue
+		}
+		docs = append(docs, row)
+		origin = append(origin, i)
+	}
+
+	if len(errs) > 0 && !opt.BestEffort {
+		return errs
+	}
+	if len(docs) == 0 {
+		return errs
+	}
+	defer mc.cacheInvalidate(model)
+
+	// Ordered writes stop at the first failure, which would
+	// leave the rest of the batch silently out
+	insertOpts := options.InsertMany().SetOrdered(!opt.Unordered && !opt.BestEffort)
+
+	if opt.BestEffort {
+
+		// Leave out rows whose referenced documents are missing
+		refErrs, err := refErrors(mc.refFetcher(ctx), model, bulkRows(docs)...)
+		if err != nil {
+			return append(errs, ErrorPlus{Message: err.Error()})
+		}
+		kept, keptOrigin := []interface{}{}, []int{}
+		for i := range docs {
+			if len(refErrs[i]) > 0 {
+				errs = append(errs, rowErrorPlus(origin[i], refErrs[i]...)...)
+				continue
+			}
+			kept = append(kept, docs[i])
+			keptOrigin = append(keptOrigin, origin[i])
+		}
+		docs, origin = kept, keptOrigin
+		if len(docs) == 0 {
+			return errs
+		}
+
+		result, err := mc.Collection(model).InsertMany(ctx, docs, insertOpts)
+		if err != nil {
+			errs = append(errs, bulkWriteErrorPlus(model, err, origin)...)
+		}
+		if result == nil {
+			return errs
+		}
+
+		// Rows failing validation post inserting to DB are
+		// taken out again
+		rowErrs, invalid, err := mc.validateInserted(ctx, model, result.InsertedIDs, origin)
+		if err != nil {
+			return append(errs, ErrorPlus{Message: err.Error()})
+		}
+		errs = append(errs, rowErrs...)
+		if len(invalid) > 0 {
+			_, err = mc.Collection(model).DeleteMany(ctx, bson.M{"_id": bson.M{"$in": invalid}})
+			if err != nil {
+				errs = append(errs, ErrorPlus{Message: err.Error()})
+			}
+		}
+
+		// Audit trail (of the rows kept)
+		if isAudited(model) {
+			if err = mc.auditInserted(ctx, model, bulkKept(result.InsertedIDs, invalid)); err != nil {
+				errs = append(errs, ErrorPlus{Message: err.Error()})
+			}
+		}
+		return errs
+	}
+
+	var manyErrs []ErrorPlus
+	fn := func(sessCtx mongo.SessionContext) error {
+		manyErrs = nil
+
+		// Referenced documents must exist
+		refErrs, err := refErrors(mc.refFetcher(sessCtx), model, bulkRows(docs)...)
+		if err != nil {
+			return err
+		}
+		for i := range docs {
+			manyErrs = append(manyErrs, rowErrorPlus(origin[i], refErrs[i]...)...)
+		}
+		if len(manyErrs) > 0 {
+			return manyErrs[0]
+		}
+
+		// Insert
+		result, err := mc.Collection(model).InsertMany(sessCtx, docs, insertOpts)
+		if err != nil {
+			if mongoErrorHasLabel(err, "TransientTransactionError") {
+				return err
+			}
+			manyErrs = bulkWriteErrorPlus(model, err, origin)
+			return manyErrs[0]
+		}
+
+		// Read, and validate post inserting to DB
+		manyErrs, _, err = mc.validateInserted(sessCtx, model, result.InsertedIDs, origin)
+		if err != nil {
+			return err
+		}
+		if len(manyErrs) > 0 {
+			return manyErrs[0]
+		}
+
+		// Audit trail
+		if isAudited(model) {
+			return mc.auditInserted(sessCtx, model, result.InsertedIDs)
+		}
+
+		return nil
+	}
+
+	err := mc.TransactionallyCtx(ctx, fn)
+	if err != nil {
+		if manyErrs != nil && len(manyErrs) > 0 && manyErrs[0] == err {
+			return manyErrs
+		} else {
+			return []ErrorPlus{{Message: err.Error()}}
+		}
+	}
+
+	return []ErrorPlus{}
+}
+
+// Reads back inserted documents (in one query) and validates
+// them. Returns errors of the rows, and ids of the invalid
+// documents. Ids not found (documents not inserted) are skipped
+func (mc *MongoConnect) validateInserted(ctx context.Context, model interface{}, ids []interface{}, origin []int) ([]ErrorPlus, []interface{}, error) {
+	cursor, err := mc.Collection(model).Find(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return nil, nil, err
+	}
+	raws := []bson.Raw{}
+	if err = cursor.All(ctx, &raws); err != nil {
+		return nil, nil, err
+	}
+
+	found := map[string]bson.Raw{}
+	for _, raw := range raws {
+		var id interface{}
+		if err = raw.Lookup("_id").Unmarshal(&id); err != nil {
+			return nil, nil, err
+		}
+		found[refKey(id)] = raw
+	}
+
+	return validateInsertedRaws(model, ids, origin, found)
+}
+
+// Validates the documents found (keyed by refKey of their
+// ids), in the order of ids
+func validateInsertedRaws(model interface{}, ids []interface{}, origin []int, found map[string]bson.Raw) ([]ErrorPlus, []interface{}, error) {
+	errs := []ErrorPlus{}
+	invalid := []interface{}{}
+	for i, id := range ids {
+		raw, ok := found[refKey(id)]
+		if !ok {
+			continue
+		}
+		object := reflect.New(TypeDereference(TypeOf(model))).Interface()
+		err := bson.Unmarshal(raw, object)
+		if err == nil {
+			err = decryptFields(object)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if objErrs := ModelValidateObject(object); len(objErrs) > 0 {
+			errs = append(errs, rowErrorPlus(origin[i], objErrs...)...)
+			invalid = append(invalid, id)
+		}
+	}
+	return errs, invalid, nil
+}
+
+// Counts documents taken in DB, and rows of the batch
+// accepted so far, so that duplicates within it are caught
+func bulkUniqueCounter(count func(filter interface{}) (int64, error), docs *[]interface{}) func(filter interface{}) (int64, error) {
+	return func(filter interface{}) (int64, error) {
+		n, err := count(filter)
+		if err != nil {
+			return 0, err
+		}
+		for _, d := range *docs {
+			if memoryMatch(bson.M(d.(Map)), filter) {
+				n++
+			}
+		}
+		return n, nil
+	}
+}
+
+// Ids other than the invalid ones
+func bulkKept(ids []interface{}, invalid []interface{}) []interface{} {
+	dropped := map[string]bool{}
+	for _, id := range invalid {
+		dropped[refKey(id)] = true
+	}
+	kept := []interface{}{}
+	for _, id := range ids {
+		if !dropped[refKey(id)] {
+			kept = append(kept, id)
+		}
+	}
+	return kept
+}
+
+func bulkRows(docs []interface{}) []Map {
+	rows := make([]Map, len(docs))
+	for i, d := range docs {
+		rows[i] = d.(Map)
+	}
+	return rows
+}
+
+func rowErrorPlus(row int, errs ...ErrorPlus) []ErrorPlus {
+	output := make([]ErrorPlus, len(errs))
+	for i, e := range errs {
+		source := fmt.Sprintf("[%d]", row)
+		if e.Source != "" {
+			source += "." + e.Source
+		}
+		output[i] = ErrorPlus{Message: e.Message, Source: source}
+	}
+	return output
+}
+
+// Maps write errors of InsertMany back to the rows given
+func bulkWriteErrorPlus(model interface{}, err error, origin []int) []ErrorPlus {
+	var bwe mongo.BulkWriteException
+	if !errors.As(err, &bwe) || len(bwe.WriteErrors) == 0 {
+		return []ErrorPlus{{Message: err.Error()}}
+	}
+
+	output := []ErrorPlus{}
+	for _, we := range bwe.WriteErrors {
+		row := we.Index
+		if row >= 0 && row < len(origin) {
+			row = origin[row]
+		}
+		if we.Code == 11000 || we.Code == 11001 || we.Code == 12582 {
+			output = append(output, rowErrorPlus(row, duplicateKeyErrorPlus(model, we.Message)...)...)
+			continue
+		}
+		output = append(output, rowErrorPlus(row, ErrorPlus{Message: we.Message})...)
+	}
+	return output
+}
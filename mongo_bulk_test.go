@@ -0,0 +1,101 @@
+package do
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type bulkRow struct {
+	MongoEntity
+	ID   int    `bson:"_id" json:"id"`
+	Name string `bson:"name" json:"name"`
+}
+
+func (bulkRow) AfterSave(object interface{}) []ErrorPlus {
+	if object.(*bulkRow).Name == "" {
+		return []ErrorPlus{{Message: "no name", Source: "name"}}
+	}
+	return nil
+}
+
+func TestValidateInserted(t *testing.T) {
+
+	found := map[string]bson.Raw{}
+	for _, doc := range []bson.M{{"_id": 1, "name": "a"}, {"_id": 2}, {"_id": 4, "name": "d"}} {
+		b, _ := bson.Marshal(doc)
+		found[refKey(doc["_id"])] = b
+	}
+
+	// Errors are reported against the rows given, in
+	// order. Rows not inserted (3) are skipped
+	errs, invalid, err := validateInsertedRaws(bulkRow{}, []interface{}{int32(1), int32(2), int32(3), int32(4)}, []int{0, 2, 5, 6}, found)
+	assert.Nil(t, err)
+	assert.Equal(t, []ErrorPlus{{Message: "no name", Source: "[2].name"}}, errs)
+	assert.Equal(t, []interface{}{int32(2)}, invalid)
+}
+
+func TestRowErrorPlus(t *testing.T) {
+	errs := rowErrorPlus(42, ErrorPlus{Message: "bad email", Source: "email"}, ErrorPlus{Message: "oops"})
+	assert.Equal(t, "[42].email", errs[0].Source)
+	assert.Equal(t, "[42]", errs[1].Source)
+}
+
+func TestBulkWriteErrorPlus(t *testing.T) {
+
+	// Index of write error is within the docs sent, which
+	// maps back to the rows given
+	err := mongo.BulkWriteException{
+		WriteErrors: []mongo.BulkWriteError{
+			{WriteError: mongo.WriteError{Index: 1, Message: "duplicate"}},
+		},
+	}
+	errs := bulkWriteErrorPlus("rows", err, []int{0, 3, 4})
+	assert.Equal(t, 1, len(errs))
+	assert.Equal(t, "[3]", errs[0].Source)
+	assert.Equal(t, "duplicate", errs[0].Message)
+
+	// Duplicate keys are reported against the fields
+	err = mongo.BulkWriteException{
+		WriteErrors: []mongo.BulkWriteError{
+			{WriteError: mongo.WriteError{Index: 2, Code: 11000, Message: `E11000 duplicate key error collection: db.rows index: email_1 dup key: { email: "a@b.com" }`}},
+		},
+	}
+	errs = bulkWriteErrorPlus("rows", err, []int{0, 3, 4})
+	assert.Equal(t, []ErrorPlus{{Message: "already taken", Source: "[4].email"}}, errs)
+
+	// Other errors pass through
+	errs = bulkWriteErrorPlus("rows", errors.New("boom"), []int{0})
+	assert.Equal(t, []ErrorPlus{{Message: "boom"}}, errs)
+}
+
+func TestBulkUniqueCounter(t *testing.T) {
+
+	ms := NewMemoryStore()
+	ms.InsertForm(&uniqUser{}, Map{"email": "a@b.com"})
+
+	// Taken in DB, or by an earlier row of the batch
+	docs := []interface{}{}
+	count := bulkUniqueCounter(ms.uniqueCounter(uniqUser{}), &docs)
+	taken := [][]ErrorPlus{}
+	for _, row := range []Map{{"email": "a@b.com"}, {"email": "c@d.com"}, {"email": "c@d.com"}} {
+		errs, err := uniqueErrors(uniqUser{}, row, nil, count)
+		assert.Nil(t, err)
+		taken = append(taken, errs)
+		if len(errs) == 0 {
+			docs = append(docs, row)
+		}
+	}
+	assert.Equal(t, []ErrorPlus{{Message: "already taken", Source: "email"}}, taken[0])
+	assert.Equal(t, 0, len(taken[1]))
+	assert.Equal(t, []ErrorPlus{{Message: "already taken", Source: "email"}}, taken[2])
+}
+
+func TestBulkKept(t *testing.T) {
+	ids := []interface{}{"a", "b", "c"}
+	assert.Equal(t, []interface{}{"a", "c"}, bulkKept(ids, []interface{}{"b"}))
+	assert.Equal(t, ids, bulkKept(ids, nil))
+}
@@ -0,0 +1,282 @@
+package do
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+	READ THROUGH CACHE
+
+	cache := do.NewMongoCache(1000, time.Minute)
+	do.UseMongoCache(cache)
+
+	Documents read with FindByID are kept in memory (least
+	recently used are evicted beyond size, and all expire
+	after ttl). Any write to a collection made through
+	MongoConnect drops the cached documents of that collection.
+
+	Writes made in a transaction (of Transactionally) drop the
+	cache once the transaction is over, so that readers don't
+	cache the old document after its commit. Reads made in a
+	transaction skip the cache
+*/
+
+type MongoCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[string]*list.Element
+	byColl  map[string]map[string]*list.Element
+	lru     *list.List
+
+	// Bumped on every invalidation of a collection, so that
+	// a read that raced with a write is not cached
+	gens map[string]int64
+
+	hits   int64
+	misses int64
+}
+
+type mongoCacheEntry struct {
+	coll    string
+	key     string
+	raw     bson.Raw
+	expires time.Time
+}
+
+type MongoCacheStats struct {
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+	Entries int   `json:"entries"`
+}
+
+// Cache used by MongoConnects (from NewMongoConnect)
+var mongoCache *MongoCache = nil
+
+func UseMongoCache(c *MongoCache) {
+	mongoCache = c
+}
+
+func NewMongoCache(size int, ttl time.Duration) *MongoCache {
+	return &MongoCache{
+		size:    size,
+		ttl:     ttl,
+		entries: map[string]*list.Element{},
+		byColl:  map[string]map[string]*list.Element{},
+		lru:     list.New(),
+		gens:    map[string]int64{},
+	}
+}
+
+func (c *MongoCache) Stats() MongoCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return MongoCacheStats{
+		Hits:    c.hits,
+		Misses:  c.misses,
+		Entries: c.lru.Len(),
+	}
+}
+
+func (c *MongoCache) get(coll string, id interface{}) (bson.Raw, int64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := mongoCacheKey(coll, id)
+	el, ok := c.entries[key]
+	if ok && time.Now().After(el.Value.(*mongoCacheEntry).expires) {
+		c.remove(el)
+		ok = false
+	}
+	if !ok {
+		c.misses++
+		return nil, c.gens[coll], false
+	}
+
+	c.hits++
+	c.lru.MoveToFront(el)
+	return el.Value.(*mongoCacheEntry).raw, c.gens[coll], true
+}
+
+// Caches a document read when the collection was at
+// generation gen (unless it has been invalidated since)
+func (c *MongoCache) put(coll string, gen int64, id interface{}, raw bson.Raw) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.gens[coll] != gen {
+		return
+	}
+
+	key := mongoCacheKey(coll, id)
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+
+	el := c.lru.PushFront(&mongoCacheEntry{
+		coll:    coll,
+		key:     key,
+		raw:     raw,
+		expires: time.Now().Add(c.ttl),
+	})
+	c.entries[key] = el
+	if c.byColl[coll] == nil {
+		c.byColl[coll] = map[string]*list.Element{}
+	}
+	c.byColl[coll][key] = el
+
+	for c.size > 0 && c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+// Drops all cached documents of a collection
+func (c *MongoCache) invalidate(coll string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gens[coll]++
+	for _, el := range c.byColl[coll] {
+		c.remove(el)
+	}
+}
+
+func (c *MongoCache) remove(el *list.Element) {
+	entry := el.Value.(*mongoCacheEntry)
+	c.lru.Remove(el)
+	delete(c.entries, entry.key)
+	delete(c.byColl[entry.coll], entry.key)
+	if len(c.byColl[entry.coll]) == 0 {
+		delete(c.byColl, entry.coll)
+	}
+}
+
+// Type is part of the key, so that "1" and 1 differ
+func mongoCacheKey(coll string, id interface{}) string {
+	return fmt.Sprintf("%s|%T|%v", coll, id, id)
+}
+
+// Full name (connection, database and collection) of the
+// model, so that tenants and connections to other servers
+// don't share cached documents
+func (mc *MongoConnect) cacheNamespace(model interface{}) string {
+	db := mc.DB
+	if mc.DBSuffix != "" {
+		db = fmt.Sprintf("%s-%s", mc.DB, mc.DBSuffix)
+	}
+	return mongoPoolKey(mc.Name, mc.ConnStr) + "/" + db + "." + mc.CollectionName(model)
+}
+
+// Drops the cached documents of the model, right away or,
+// for writes in a transaction, once it is over
+func (mc *MongoConnect) cacheInvalidate(model interface{}, sessCtx ...mongo.SessionContext) {
+	if mc.Cache == nil {
+		return
+	}
+	ns := mc.cacheNamespace(model)
+	if len(sessCtx) > 0 && sessCtx[0] != nil {
+		if pending, ok := sessCtx[0].Value(cachePendingKey{}).(*cachePending); ok {
+			pending.add(mc.Cache, ns)
+			return
+		}
+	}
+	mc.Cache.invalidate(ns)
+}
+
+// Collections written in a transaction, to drop from
+// their caches when it's over
+type cachePending struct {
+	mu    sync.Mutex
+	colls map[*MongoCache]map[string]bool
+}
+
+type cachePendingKey struct{}
+
+func (p *cachePending) add(c *MongoCache, coll string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.colls == nil {
+		p.colls = map[*MongoCache]map[string]bool{}
+	}
+	if p.colls[c] == nil {
+		p.colls[c] = map[string]bool{}
+	}
+	p.colls[c][coll] = true
+}
+
+func (p *cachePending) flush() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for c, colls := range p.colls {
+		for coll := range colls {
+			c.invalidate(coll)
+		}
+	}
+	p.colls = nil
+}
+
+func (mc *MongoConnect) FindByID(addrObject interface{}, id interface{}) error {
+	return mc.FindByIDCtx(context.Background(), addrObject, id)
+}
+
+// Reads the document with given _id into addrObject, from
+// the cache (if any) or else the DB. Returns ErrNotFound
+// if there is no such document
+func (mc *MongoConnect) FindByIDCtx(ctx context.Context, addrObject interface{}, id interface{}) error {
+
+	mc = mc.forModel(addrObject)
+
+	// Reads in a transaction may see its uncommitted writes
+	cache := mc.Cache
+	if mongo.SessionFromContext(ctx) != nil {
+		cache = nil
+	}
+
+	ns := ""
+	gen := int64(0)
+	if cache != nil {
+		ns = mc.cacheNamespace(addrObject)
+		raw, g, ok := cache.get(ns, id)
+		if ok {
+			if err := bson.Unmarshal(raw, addrObject); err != nil {
+				return err
+			}
+			return decryptFields(addrObject)
+		}
+		gen = g
+	}
+
+	ctx, cancel := mc.timeout(ctx, "query")
+	defer cancel()
+
+	find := options.FindOne()
+	if projection := queryProjection(addrObject, nil); projection != nil {
+		find.SetProjection(projection)
+	}
+	raw, err := mc.Collection(addrObject).FindOne(ctx, excludeSoftDeleted(addrObject, bson.M{"_id": id}), find).DecodeBytes()
+	if err == mongo.ErrNoDocuments {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	if cache != nil {
+		cache.put(ns, gen, id, raw)
+	}
+	if err = bson.Unmarshal(raw, addrObject); err != nil {
+		return err
+	}
+	return decryptFields(addrObject)
+}
@@ -0,0 +1,92 @@
+package do
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestMongoCache(t *testing.T) {
+
+	c := NewMongoCache(2, time.Minute)
+	raw, _ := bson.Marshal(bson.M{"_id": "a"})
+
+	_, gen, ok := c.get("db.items", "a")
+	assert.False(t, ok)
+	c.put("db.items", gen, "a", raw)
+	got, _, ok := c.get("db.items", "a")
+	assert.True(t, ok)
+	assert.Equal(t, bson.Raw(raw), got)
+
+	// Type of id is part of the key
+	_, _, ok = c.get("db.items", 1)
+	assert.False(t, ok)
+
+	// Least recently used is evicted
+	c.put("db.items", gen, "b", raw)
+	c.get("db.items", "a")
+	c.put("db.items", gen, "c", raw)
+	_, _, ok = c.get("db.items", "b")
+	assert.False(t, ok)
+	_, _, ok = c.get("db.items", "a")
+	assert.True(t, ok)
+
+	// Writes drop the whole collection, and reads that
+	// started before the write are not cached
+	c.put("db.other", 0, "a", raw)
+	c.invalidate("db.items")
+	_, _, ok = c.get("db.items", "a")
+	assert.False(t, ok)
+	c.put("db.items", gen, "a", raw)
+	_, _, ok = c.get("db.items", "a")
+	assert.False(t, ok)
+	_, _, ok = c.get("db.other", "a")
+	assert.True(t, ok)
+
+	stats := c.Stats()
+	assert.Equal(t, int64(4), stats.Hits)
+	assert.Equal(t, int64(5), stats.Misses)
+	assert.Equal(t, 1, stats.Entries)
+
+	// Entries expire
+	c = NewMongoCache(10, -time.Second)
+	c.put("db.items", 0, "a", raw)
+	_, _, ok = c.get("db.items", "a")
+	assert.False(t, ok)
+}
+
+func TestCacheInvalidate(t *testing.T) {
+
+	mc := &MongoConnect{DB: "db", Cache: NewMongoCache(10, time.Minute)}
+	raw, _ := bson.Marshal(bson.M{"_id": "a"})
+	ns := mc.cacheNamespace(memTicket{})
+
+	// Outside a transaction, right away
+	mc.Cache.put(ns, 0, "a", raw)
+	mc.cacheInvalidate(memTicket{})
+	_, gen, ok := mc.Cache.get(ns, "a")
+	assert.False(t, ok)
+
+	// In one, once it is over
+	pending := &cachePending{}
+	sessCtx := mongo.NewSessionContext(context.WithValue(context.Background(), cachePendingKey{}, pending), &memorySession{})
+	mc.Cache.put(ns, gen, "a", raw)
+	mc.cacheInvalidate(memTicket{}, sessCtx)
+	_, gen, ok = mc.Cache.get(ns, "a")
+	assert.True(t, ok)
+
+	pending.flush()
+	_, _, ok = mc.Cache.get(ns, "a")
+	assert.False(t, ok)
+}
+
+func TestCacheNamespace(t *testing.T) {
+	a := &MongoConnect{DB: "db", ConnStr: "mongodb://a"}
+	assert.NotEqual(t, a.cacheNamespace(memTicket{}), (&MongoConnect{DB: "db", ConnStr: "mongodb://b"}).cacheNamespace(memTicket{}))
+	assert.NotEqual(t, a.cacheNamespace(memTicket{}), (&MongoConnect{DB: "db", ConnStr: "mongodb://a", Name: "analytics"}).cacheNamespace(memTicket{}))
+	assert.NotEqual(t, a.cacheNamespace(memTicket{}), (&MongoConnect{DB: "db", ConnStr: "mongodb://a", DBSuffix: "acme"}).cacheNamespace(memTicket{}))
+}
@@ -3,8 +3,12 @@ package do
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"reflect"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/k0kubun/pp"
 	"github.com/rightjoin/fig"
@@ -12,6 +16,8 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
 type MongoConnect struct {
@@ -22,23 +28,40 @@ type MongoConnect struct {
 	Coll       string // optional
 	CollSuffix string // optional
 
-	// TODO: evaluate reuse of client
+	Name string // optional, see NewMongoConnectNamed
+
+	Cache *MongoCache // optional (see FindByID)
+
+	// Borrowed from the process wide pool
 	client *mongo.Client
+
+	// Other named connections, that models picked
+	named   map[string]*MongoConnect
+	namedMu sync.RWMutex
 }
 
 func NewMongoConnect() *MongoConnect {
 	return &MongoConnect{
 		ConnStr: fig.String("database.mongo.connection"),
 		DB:      fig.String("database.mongo.db"),
+		Cache:   mongoCache,
 	}
 }
 
+// Returns the client to the pool. The underlying
+// connections stay open for other MongoConnects to use
+// (see MongoPoolClose to disconnect them)
 func (mc *MongoConnect) CloseClient() {
 	if mc.client != nil {
-		if err := mc.client.Disconnect(context.TODO()); err != nil {
-			log.Error().Msg("unable to close mongodb client connection")
-		}
+		mongoPoolRelease(mongoPoolKey(mc.Name, mc.ConnStr))
+		mc.client = nil
 	}
+	mc.namedMu.Lock()
+	defer mc.namedMu.Unlock()
+	for _, other := range mc.named {
+		other.CloseClient()
+	}
+	mc.named = nil
 }
 
 func (mc *MongoConnect) Client() *mongo.Client {
@@ -47,7 +70,7 @@ func (mc *MongoConnect) Client() *mongo.Client {
 		return mc.client
 	}
 
-	client, err := mongo.Connect(context.TODO(), options.Client().ApplyURI(mc.ConnStr))
+	client, err := mongoPoolBorrow(mc.Name, mc.ConnStr)
 	if err != nil {
 		log.Error().
 			Err(err).
@@ -67,7 +90,51 @@ func (mc *MongoConnect) Database() *mongo.Database {
 	}
 }
 
+// Collection of the model, with read preference, read concern
+// and write concern applied as declared by the model
 func (mc *MongoConnect) Collection(model ...interface{}) *mongo.Collection {
+	if len(model) > 0 {
+		if other := mc.forModel(model[0]); other != mc {
+			return other.Collection(model...)
+		}
+		if mo := MongoOptions(model[0]); mo != nil {
+			return mc.Database().Collection(mc.CollectionName(model...), mo.collectionOptions())
+		}
+	}
+	return mc.Database().Collection(mc.CollectionName(model...))
+}
+
+// Collection to read from, with per query overrides applied
+func (mc *MongoConnect) queryCollection(model interface{}, opt QueryOptions) (*mongo.Collection, error) {
+	coll := mc.Collection(model)
+	if opt.ReadPreference == nil && opt.ReadConcern == nil {
+		return coll, nil
+	}
+
+	override := options.Collection()
+	if opt.ReadPreference != nil {
+		override.SetReadPreference(opt.ReadPreference)
+	}
+	if opt.ReadConcern != nil {
+		override.SetReadConcern(opt.ReadConcern)
+	}
+	return coll.Clone(override)
+}
+
+// Collation of the query, else the one declared by the model
+func queryCollation(model interface{}, opt QueryOptions) *options.Collation {
+	if opt.Collation != nil {
+		return opt.Collation
+	}
+	if mo := MongoOptions(model); mo != nil {
+		return mo.Collation
+	}
+	return nil
+}
+
+// Name of the collection (suffix included) that
+// Collection would return
+func (mc *MongoConnect) CollectionName(model ...interface{}) string {
 
 	coll := ""
 	if len(model) == 0 {
@@ -77,13 +144,22 @@ func (mc *MongoConnect) Collection(model ...interface{}) *mongo.Collection {
 	}
 
 	if mc.CollSuffix == "" {
-		return mc.Database().Collection(coll)
+		return coll
 	} else {
-		return mc.Database().Collection(fmt.Sprintf("%s-%s", coll, mc.CollSuffix))
+		return fmt.Sprintf("%s-%s", coll, mc.CollSuffix)
 	}
 }
 
 func (mc *MongoConnect) Query(model interface{}, addrSlice interface{}, opts ...QueryOptions) (int, error) {
+	return mc.QueryCtx(context.Background(), model, addrSlice, opts...)
+}
+
+func (mc *MongoConnect) QueryCtx(ctx context.Context, model interface{}, addrSlice interface{}, opts ...QueryOptions) (int, error) {
+
+	mc = mc.forModel(model)
+
+	ctx, cancel := mc.timeout(ctx, "query")
+	defer cancel()
 
 	var opt = QueryOptions{
 		Query: bson.D{},
@@ -92,18 +168,42 @@ func (mc *MongoConnect) Query(model interface{}, addrSlice interface{}, opts ...
 	if len(opts) != 0 {
 		opt = opts[0]
 	}
+	if opt.After != "" || opt.Before != "" {
+		return 0, errKeysetCursor
+	}
+
+	// Leave out soft deleted documents, unless asked for
+	if !opt.WithDeleted {
+		opt.Query = excludeSoftDeleted(model, opt.Query)
+	}
+
+	coll, err := mc.queryCollection(model, opt)
+	if err != nil {
+		return 0, err
+	}
+	collation := queryCollation(model, opt)
+	projection := queryProjection(model, opt.Projection)
 
 	if !opt.Paginate {
-		cursor, err := mc.Collection(model).Find(context.Background(), opt.Query, &options.FindOptions{
-			Skip:  P_int64(int64(opt.Skip)),
-			Limit: P_int64(int64(opt.Limit)),
-			Sort:  opt.Sort,
+		cursor, err := coll.Find(ctx, opt.Query, &options.FindOptions{
+			Skip:       P_int64(int64(opt.Skip)),
+			Limit:      P_int64(int64(opt.Limit)),
+			Sort:       opt.Sort,
+			Collation:  collation,
+			Projection: projection,
 		})
 		if err != nil {
 			return 0, err
 		}
 
-		err = cursor.All(context.Background(), addrSlice)
+		err = cursor.All(ctx, addrSlice)
+		if err == nil {
+			err = decryptFields(addrSlice)
+		}
+		if err != nil {
+			return 0, err
+		}
+		err = populateRefs(mc.refFetcher(ctx), model, addrSlice, opt.Populate)
 		if err != nil {
 			return 0, err
 		}
@@ -113,7 +213,7 @@ func (mc *MongoConnect) Query(model interface{}, addrSlice interface{}, opts ...
 	}
 
 	// Find total number of records in DB
-	total, err := mc.Collection(model).CountDocuments(context.Background(), opt.Query)
+	total, err := coll.CountDocuments(ctx, opt.Query, &options.CountOptions{Collation: collation})
 	if err != nil {
 		pp.Println("01")
 		return 0, err
@@ -128,17 +228,26 @@ func (mc *MongoConnect) Query(model interface{}, addrSlice interface{}, opts ...
 	}
 
 	// Find records
-	cursor, err := mc.Collection(model).Find(context.Background(), opt.Query, &options.FindOptions{
-		Skip:  P_int64(int64((opt.Page - 1) * opt.Chunk)),
-		Limit: P_int64(int64(opt.Chunk)),
-		Sort:  opt.Sort,
+	cursor, err := coll.Find(ctx, opt.Query, &options.FindOptions{
+		Skip:       P_int64(int64((opt.Page - 1) * opt.Chunk)),
+		Limit:      P_int64(int64(opt.Chunk)),
+		Sort:       opt.Sort,
+		Collation:  collation,
+		Projection: projection,
 	})
 	if err != nil {
 		pp.Println("02")
 		return 0, err
 	}
 
-	err = cursor.All(context.Background(), addrSlice)
+	err = cursor.All(ctx, addrSlice)
+	if err == nil {
+		err = decryptFields(addrSlice)
+	}
+	if err != nil {
+		return 0, err
+	}
+	err = populateRefs(mc.refFetcher(ctx), model, addrSlice, opt.Populate)
 	if err != nil {
 		return 0, err
 	}
@@ -146,21 +255,76 @@ func (mc *MongoConnect) Query(model interface{}, addrSlice interface{}, opts ...
 	return int(total), nil
 }
 
+// Filter and update of an UpdateForm. Versioned documents are
+// updated only if the version given matches the one in DB, and
+// the version is bumped. inputs are left as they are
+func updateDocument(addrObject interface{}, queryOne interface{}, inputs Map) (interface{}, bson.M) {
+	set := Map{}
+	for k, v := range inputs {
+		set[k] = v
+	}
+
+	filter := queryOne
+	update := bson.M{"$set": set}
+	if isVersioned(addrObject) {
+		filter = bson.M{"$and": bson.A{queryOne, bson.M{"version": inputs["version"]}}}
+		update["$inc"] = bson.M{"version": 1}
+		delete(set, "version")
+	}
+	return filter, update
+}
+
 type QueryOptions struct {
 	Query interface{}
 	Sort  interface{}
 	Skip  int
 	Limit int
 
+	// Fields to include (or exclude), see ExtractQueryProjection.
+	// Fields tagged select:"never" are never returned
+	Projection bson.M
+
 	// When Paginate EQ true, then 'skip' and 'limit' are
 	// essentially ignored. Otherwise 'page' and 'chunk'
 	// get ignored
 	Paginate bool
 	Page     int
 	Chunk    int
+
+	// Keyset pagination (see QueryKeyset) uses 'chunk'
+	// along with one of these opaque cursors. Query
+	// fails when either is set
+	After  string
+	Before string
+
+	// Number of documents fetched per round trip,
+	// when streaming (see QueryEach)
+	BatchSize int
+
+	// Overrides of what the model declares (see MongoOptions)
+	ReadPreference *readpref.ReadPref
+	ReadConcern    *readconcern.ReadConcern
+	Collation      *options.Collation
+
+	// References (see modelRefs) to fetch and set into
+	// their sibling fields
+	Populate []string
+
+	// Include documents that have been soft deleted
+	// (applies to models composed of SoftDeleted)
+	WithDeleted bool
 }
 
 func (mc *MongoConnect) Transactionally(doAction func(sessCtx mongo.SessionContext) error) error {
+	return mc.TransactionallyCtx(context.Background(), doAction)
+}
+
+// Same as Transactionally, but the transaction (and all work
+// done using sessCtx) gets aborted when ctx is done
+func (mc *MongoConnect) TransactionallyCtx(ctx context.Context, doAction func(sessCtx mongo.SessionContext) error) error {
+
+	ctx, cancel := mc.timeout(ctx, "transaction")
+	defer cancel()
 
 	// Session
 	session, err := mc.Client().StartSession()
@@ -169,52 +333,131 @@ func (mc *MongoConnect) Transactionally(doAction func(sessCtx mongo.SessionConte
 	}
 	defer session.EndSession(context.Background())
 
-	err = mongo.WithSession(context.Background(), session, func(sessCtx mongo.SessionContext) error {
+	pending := &cachePending{}
+	defer pending.flush()
 
-		var output error
+	retries := fig.IntOr(3, "database.mongo.transaction.retries")
+	for attempt := 0; ; attempt++ {
 
-		// Start the transaction
-		if output = session.StartTransaction(); output != nil {
-			return output
-		}
+		committing := false
+		err = mongo.WithSession(ctx, session, func(sessCtx mongo.SessionContext) error {
 
-		// Do the work
-		output = doAction(sessCtx)
-		if output != nil {
-			return output
+			var output error
+
+			// Writes leave the cache alone until the transaction
+			// is over (see cacheInvalidate)
+			sessCtx = mongo.NewSessionContext(context.WithValue(sessCtx, cachePendingKey{}, pending), session)
+
+			// Start the transaction
+			if output = session.StartTransaction(); output != nil {
+				return output
+			}
+
+			// Do the work
+			output = doAction(sessCtx)
+			if output != nil {
+				return output
+			}
+
+			// Commit the transaction, retrying the commit alone
+			// when its outcome is unknown
+			committing = true
+			for commit := 0; ; commit++ {
+				output = session.CommitTransaction(sessCtx)
+				if output == nil {
+					return nil
+				}
+				if commit >= retries || !mongoErrorHasLabel(output, "UnknownTransactionCommitResult") {
+					return output
+				}
+				if !transactionBackoff(ctx, commit) {
+					return output
+				}
+			}
+		})
+		if err == nil {
+			return nil
 		}
 
-		// Commit the transaction
-		if output = session.CommitTransaction(sessCtx); output != nil {
-			return output
+		// A failed commit leaves nothing to abort
+		if !committing {
+			abortErr := session.AbortTransaction(context.Background())
+			if abortErr != nil {
+				log.Error().
+					Err(abortErr).
+					AnErr("cause", err).
+					Msg("unable to abort mongodb transaction")
+			}
 		}
 
-		return nil
-	})
-	if err != nil {
-		abortErr := session.AbortTransaction(context.Background())
-		if abortErr != nil {
-			// TODO: log abort error
+		// Rerun the whole transaction on transient errors
+		// (such as write conflicts)
+		if attempt >= retries || !mongoErrorHasLabel(err, "TransientTransactionError") {
+			return err
+		}
+		if !transactionBackoff(ctx, attempt) {
+			return err
 		}
-		return err
 	}
+}
 
-	return nil
+func mongoErrorHasLabel(err error, label string) bool {
+	var se mongo.ServerError
+	if errors.As(err, &se) {
+		return se.HasErrorLabel(label)
+	}
+	return false
+}
+
+// Sleeps before the next retry (doubling the delay on every
+// attempt). Returns false if ctx got done meanwhile
+func transactionBackoff(ctx context.Context, attempt int) bool {
+	ms := fig.IntOr(50, "database.mongo.transaction.backoff")
+	delay := time.Duration(ms) * time.Millisecond << uint(attempt)
+
+	select {
+	case <-time.After(delay):
+		return true
+	case <-ctx.Done():
+		return false
+	}
 }
 
 func (mc *MongoConnect) InsertForm(addrObject interface{}, inputs Map, sessCtx ...mongo.SessionContext) []ErrorPlus {
+	return mc.InsertFormCtx(context.Background(), addrObject, inputs, sessCtx...)
+}
+
+func (mc *MongoConnect) InsertFormCtx(ctx context.Context, addrObject interface{}, inputs Map, sessCtx ...mongo.SessionContext) []ErrorPlus {
+
+	mc = mc.forModel(addrObject)
 
 	// Validate inputs for validation errors before sending
 	// inputs to DB
 	errors := ModelValidateInputs(addrObject, DB_INSERT, inputs)
+	taken, err := uniqueErrors(addrObject, inputs, nil, mc.uniqueCounter(ctx, addrObject))
+	if err != nil {
+		return []ErrorPlus{{Message: err.Error()}}
+	}
+	errors = append(errors, taken...)
 	if len(errors) > 0 {
 		return errors
 	}
+	defer mc.cacheInvalidate(addrObject, sessCtx...)
 
 	var manyErrs []ErrorPlus
-	var err error
+	audited := isAudited(addrObject)
 	fn := func(sessCtx mongo.SessionContext) error {
 
+		// Referenced documents must exist
+		refErrs, err := refErrors(mc.refFetcher(sessCtx), addrObject, inputs)
+		if err != nil {
+			return err
+		}
+		if len(refErrs[0]) > 0 {
+			manyErrs = refErrs[0]
+			return manyErrs[0]
+		}
+
 		// Insert
 		result, err := mc.Collection(addrObject).InsertOne(sessCtx, inputs)
 		if err != nil {
@@ -223,6 +466,9 @@ func (mc *MongoConnect) InsertForm(addrObject interface{}, inputs Map, sessCtx .
 
 		// Read
 		err = mc.Collection(addrObject).FindOne(sessCtx, bson.M{"_id": result.InsertedID}).Decode(addrObject)
+		if err == nil {
+			err = decryptFields(addrObject)
+		}
 		if err != nil {
 			return err
 		}
@@ -233,6 +479,15 @@ func (mc *MongoConnect) InsertForm(addrObject interface{}, inputs Map, sessCtx .
 			return manyErrs[0]
 		}
 
+		// Audit trail
+		if audited {
+			after, err := mc.auditSnapshot(sessCtx, addrObject, bson.M{"_id": result.InsertedID})
+			if err != nil {
+				return err
+			}
+			return mc.audit(sessCtx, addrObject, "insert", nil, after)
+		}
+
 		return nil
 	}
 
@@ -242,14 +497,14 @@ func (mc *MongoConnect) InsertForm(addrObject interface{}, inputs Map, sessCtx .
 	if len(sessCtx) > 0 {
 		err = fn(sessCtx[0])
 	} else {
-		err = mc.Transactionally(fn)
+		err = mc.TransactionallyCtx(ctx, fn)
 	}
 
 	if err != nil {
 		if manyErrs != nil && len(manyErrs) > 0 && manyErrs[0] == err {
 			return manyErrs
 		} else {
-			return []ErrorPlus{{Message: err.Error()}}
+			return writeErrorPlus(addrObject, err)
 		}
 	}
 
@@ -257,6 +512,10 @@ func (mc *MongoConnect) InsertForm(addrObject interface{}, inputs Map, sessCtx .
 }
 
 func (mc *MongoConnect) InsertObject(addrObject interface{}, object interface{}, sessCtx ...mongo.SessionContext) []ErrorPlus {
+	return mc.InsertObjectCtx(context.Background(), addrObject, object, sessCtx...)
+}
+
+func (mc *MongoConnect) InsertObjectCtx(ctx context.Context, addrObject interface{}, object interface{}, sessCtx ...mongo.SessionContext) []ErrorPlus {
 
 	// Encode object (data passed) into map
 	b, err := json.Marshal(object)
@@ -284,17 +543,33 @@ func (mc *MongoConnect) InsertObject(addrObject interface{}, object interface{},
 
 	// Pass on this map to InsertForm to write to DB
 	// after performing necessary Validations()
-	return mc.InsertForm(addrObject, data, sessCtx...)
+	return mc.InsertFormCtx(ctx, addrObject, data, sessCtx...)
 }
 
 func (mc *MongoConnect) UpdateForm(addrObject interface{}, queryOne interface{}, inputs Map, sessCtx ...mongo.SessionContext) []ErrorPlus {
+	return mc.UpdateFormCtx(context.Background(), addrObject, queryOne, inputs, sessCtx...)
+}
+
+func (mc *MongoConnect) UpdateFormCtx(ctx context.Context, addrObject interface{}, queryOne interface{}, inputs Map, sessCtx ...mongo.SessionContext) []ErrorPlus {
+
+	mc = mc.forModel(addrObject)
 
 	// Validate inputs for validation errors before sending
 	// inputs to DB
 	errors := ModelValidateInputs(addrObject, DB_UPDATE, inputs)
+	taken, err := uniqueErrors(addrObject, inputs, queryOne, mc.uniqueCounter(ctx, addrObject))
+	if err != nil {
+		return []ErrorPlus{{Message: err.Error()}}
+	}
+	errors = append(errors, taken...)
 	if len(errors) > 0 {
 		return errors
 	}
+	defer mc.cacheInvalidate(addrObject, sessCtx...)
+
+	// Soft deleted documents can not be updated (until restored)
+	queryOne = excludeSoftDeleted(addrObject, queryOne)
+	collation := queryCollation(addrObject, QueryOptions{})
 
 	// Are any of StateMachine fields being changed?
 	coll := MongoCollectionName(addrObject)
@@ -307,51 +582,77 @@ func (mc *MongoConnect) UpdateForm(addrObject interface{}, queryOne interface{},
 		}
 	}
 
+	filter, update := updateDocument(addrObject, queryOne, inputs)
+
 	var manyErrs []ErrorPlus
-	var err error
-	smPreValues := map[string]string{}
+	var smPreValues map[string]string
+	audited := isAudited(addrObject)
 
 	fn := func(sessCtx mongo.SessionContext) error {
 
-		// If state machine field is changed, then we need to
-		// fetcht the previous state of object as well
-		if smFieldChanged {
-			err := mc.Collection(addrObject).FindOne(sessCtx, queryOne).Decode(addrObject)
+		// Audit trail needs the document as it was
+		var before bson.M
+		if audited {
+			snap, err := mc.auditSnapshot(sessCtx, addrObject, queryOne)
 			if err != nil {
 				return err
 			}
+			before = snap
+		}
 
-			// Object to []byte
-			b, err := json.Marshal(reflect.ValueOf(addrObject).Elem().Interface())
-			if err != nil {
-				return err
-			}
+		// Referenced documents must exist
+		refErrs, err := refErrors(mc.refFetcher(sessCtx), addrObject, inputs)
+		if err != nil {
+			return err
+		}
+		if len(refErrs[0]) > 0 {
+			manyErrs = refErrs[0]
+			return manyErrs[0]
+		}
 
-			// []byte to map
-			var objMap map[string]interface{}
-			err = json.Unmarshal(b, &objMap)
+		// If state machine field is changed, then we need to
+		// fetcht the previous state of object as well
+		if smFieldChanged {
+			err := mc.Collection(addrObject).FindOne(sessCtx, queryOne, options.FindOne().SetCollation(collation)).Decode(addrObject)
+			if err == nil {
+				err = decryptFields(addrObject)
+			}
 			if err != nil {
 				return err
 			}
 
-			// Loop map and save values of state machine fields before
+			// Save values of state machine fields before
 			// update is made
-			for _, f := range smFields {
-				if pre, ok := objMap[f]; ok {
-					smPreValues[f] = pre.(string)
-				}
+			smPreValues, err = stateMachineValues(addrObject, smFields)
+			if err != nil {
+				return err
 			}
 		}
 
 		// Update
-		_, err := mc.Collection(addrObject).UpdateOne(sessCtx, queryOne, map[string]interface{}{"$set": inputs})
+		result, err := mc.Collection(addrObject).UpdateOne(sessCtx, filter, update, options.Update().SetCollation(collation))
 		if err != nil {
 			return err
 		}
-		// TODO: matched count and modified count check??
+		if result.MatchedCount == 0 {
+			// Either document is missing, or its version is stale
+			count, err := mc.Collection(addrObject).CountDocuments(sessCtx, queryOne, options.Count().SetCollation(collation))
+			if err != nil {
+				return err
+			}
+			if count == 0 {
+				manyErrs = []ErrorPlus{ErrNotFound}
+			} else {
+				manyErrs = []ErrorPlus{ErrConflict}
+			}
+			return manyErrs[0]
+		}
 
 		// Read again (after update)
-		err = mc.Collection(addrObject).FindOne(sessCtx, queryOne).Decode(addrObject)
+		err = mc.Collection(addrObject).FindOne(sessCtx, queryOne, options.FindOne().SetCollation(collation)).Decode(addrObject)
+		if err == nil {
+			err = decryptFields(addrObject)
+		}
 		if err != nil {
 			return err
 		}
@@ -363,34 +664,240 @@ func (mc *MongoConnect) UpdateForm(addrObject interface{}, queryOne interface{},
 		}
 
 		if smFieldChanged {
-			// Object to []byte
-			b, err := json.Marshal(reflect.ValueOf(addrObject).Elem().Interface())
+			err = checkStateTransitions(coll, smFields, smPreValues, addrObject)
 			if err != nil {
 				return err
 			}
+		}
 
-			// []byte to map
-			var objMap map[string]interface{}
-			err = json.Unmarshal(b, &objMap)
+		// Audit trail
+		if audited {
+			after, err := mc.auditSnapshot(sessCtx, addrObject, queryOne)
 			if err != nil {
 				return err
 			}
+			return mc.audit(sessCtx, addrObject, "update", before, after)
+		}
 
-			// See which state machine field has chagned, and
-			// if its a valid transition
-			for _, f := range smFields {
-				if post, ok := objMap[f]; ok {
-					if post.(string) != smPreValues[f] {
-						sm := getStateMachine(coll, f)
-						if sm == nil {
-							// TODO: Error
-							return fmt.Errorf("no state machine found %s.%s", coll, f)
-						} else if !sm.CanMove(smPreValues[f], post.(string)) {
-							return fmt.Errorf("invalid state transition (%s) from %s to %s", f, smPreValues[f], post)
-						}
-					}
-				}
+		return nil
+	}
+
+	// If there is already a context available
+	// then run it under it.
+	// Otherwise, start a new transaction.
+	if len(sessCtx) > 0 {
+		err = fn(sessCtx[0])
+	} else {
+		err = mc.TransactionallyCtx(ctx, fn)
+	}
+
+	if err != nil {
+		if manyErrs != nil && len(manyErrs) > 0 && manyErrs[0] == err {
+			return manyErrs
+		} else {
+			return writeErrorPlus(addrObject, err)
+		}
+	}
+
+	return []ErrorPlus{}
+}
+
+func (mc *MongoConnect) DeleteForm(addrObject interface{}, queryOne interface{}, sessCtx ...mongo.SessionContext) []ErrorPlus {
+	return mc.DeleteFormByCtx(context.Background(), addrObject, queryOne, "", sessCtx...)
+}
+
+func (mc *MongoConnect) DeleteFormCtx(ctx context.Context, addrObject interface{}, queryOne interface{}, sessCtx ...mongo.SessionContext) []ErrorPlus {
+	return mc.DeleteFormByCtx(ctx, addrObject, queryOne, "", sessCtx...)
+}
+
+// Same as DeleteForm, but also records who deleted the
+// document (for models composed of SoftDeleted)
+func (mc *MongoConnect) DeleteFormBy(addrObject interface{}, queryOne interface{}, deletedBy string, sessCtx ...mongo.SessionContext) []ErrorPlus {
+	return mc.DeleteFormByCtx(context.Background(), addrObject, queryOne, deletedBy, sessCtx...)
+}
+
+func (mc *MongoConnect) DeleteFormByCtx(ctx context.Context, addrObject interface{}, queryOne interface{}, deletedBy string, sessCtx ...mongo.SessionContext) []ErrorPlus {
+
+	mc = mc.forModel(addrObject)
+
+	var manyErrs []ErrorPlus
+	var err error
+
+	// Soft deleted documents can not be deleted again
+	isSoft := isSoftDeletable(addrObject)
+	queryOne = excludeSoftDeleted(addrObject, queryOne)
+	collation := queryCollation(addrObject, QueryOptions{})
+	audited := isAudited(addrObject)
+	defer mc.cacheInvalidate(addrObject, sessCtx...)
+
+	fn := func(sessCtx mongo.SessionContext) error {
+
+		// Audit trail needs the document as it was
+		var before bson.M
+		if audited {
+			snap, err := mc.auditSnapshot(sessCtx, addrObject, queryOne)
+			if err != nil {
+				return err
 			}
+			before = snap
+		}
+
+		// Read (before delete)
+		raw, err := mc.Collection(addrObject).FindOne(sessCtx, queryOne, options.FindOne().SetCollation(collation)).DecodeBytes()
+		if err == mongo.ErrNoDocuments {
+			manyErrs = []ErrorPlus{ErrNotFound}
+			return manyErrs[0]
+		}
+		if err != nil {
+			return err
+		}
+		if err = bson.Unmarshal(raw, addrObject); err != nil {
+			return err
+		}
+		if err = decryptFields(addrObject); err != nil {
+			return err
+		}
+
+		// Validate before deleting from DB
+		manyErrs = ModelValidateDelete(addrObject)
+		if len(manyErrs) > 0 {
+			return manyErrs[0]
+		}
+
+		// Delete (or mark as deleted)
+		if isSoft {
+			result, err := mc.Collection(addrObject).UpdateOne(sessCtx, queryOne, bson.M{"$set": bson.M{
+				"deleted_at": time.Now(),
+				"deleted_by": deletedBy,
+			}}, options.Update().SetCollation(collation))
+			if err != nil {
+				return err
+			}
+			if result.ModifiedCount == 0 {
+				manyErrs = []ErrorPlus{ErrNotFound}
+				return manyErrs[0]
+			}
+		} else {
+			result, err := mc.Collection(addrObject).DeleteOne(sessCtx, queryOne, options.Delete().SetCollation(collation))
+			if err != nil {
+				return err
+			}
+			if result.DeletedCount == 0 {
+				manyErrs = []ErrorPlus{ErrNotFound}
+				return manyErrs[0]
+			}
+		}
+
+		// Documents referring to this one (see RegisterModel)
+		policies := mongoRefPolicies{mc: mc, ctx: ctx, sessCtx: sessCtx}
+		manyErrs, err = applyDeletePolicies(policies, addrObject, raw.Lookup("_id"), isSoft, deletedBy)
+		if err != nil {
+			return err
+		}
+		if len(manyErrs) > 0 {
+			return manyErrs[0]
+		}
+
+		// Validate post deleting from DB
+		manyErrs = ModelValidateDeleted(addrObject)
+		if len(manyErrs) > 0 {
+			return manyErrs[0]
+		}
+
+		// Audit trail
+		if audited {
+			return mc.audit(sessCtx, addrObject, "delete", before, nil)
+		}
+
+		return nil
+	}
+
+	// If there is already a context available
+	// then run it under it.
+	// Otherwise, start a new transaction.
+	if len(sessCtx) > 0 {
+		err = fn(sessCtx[0])
+	} else {
+		err = mc.TransactionallyCtx(ctx, fn)
+	}
+
+	if err != nil {
+		if manyErrs != nil && len(manyErrs) > 0 && manyErrs[0] == err {
+			return manyErrs
+		} else {
+			return []ErrorPlus{{Message: err.Error()}}
+		}
+	}
+
+	return []ErrorPlus{}
+}
+
+// Undoes a soft delete. Only applies to models
+// composed of SoftDeleted
+func (mc *MongoConnect) RestoreForm(addrObject interface{}, queryOne interface{}, sessCtx ...mongo.SessionContext) []ErrorPlus {
+	return mc.RestoreFormCtx(context.Background(), addrObject, queryOne, sessCtx...)
+}
+
+func (mc *MongoConnect) RestoreFormCtx(ctx context.Context, addrObject interface{}, queryOne interface{}, sessCtx ...mongo.SessionContext) []ErrorPlus {
+
+	mc = mc.forModel(addrObject)
+
+	if !isSoftDeletable(addrObject) {
+		return []ErrorPlus{{Message: "model does not support soft deletes"}}
+	}
+
+	var manyErrs []ErrorPlus
+	var err error
+	deleted := bson.M{"$and": bson.A{queryOne, bson.M{"deleted_at": bson.M{"$ne": nil}}}}
+	collation := queryCollation(addrObject, QueryOptions{})
+	audited := isAudited(addrObject)
+	defer mc.cacheInvalidate(addrObject, sessCtx...)
+
+	fn := func(sessCtx mongo.SessionContext) error {
+
+		// Audit trail needs the document as it was
+		var before bson.M
+		if audited {
+			snap, err := mc.auditSnapshot(sessCtx, addrObject, deleted)
+			if err != nil {
+				return err
+			}
+			before = snap
+		}
+
+		// Restore
+		result, err := mc.Collection(addrObject).UpdateOne(sessCtx, deleted, bson.M{"$set": bson.M{
+			"deleted_at": nil,
+			"deleted_by": "",
+		}}, options.Update().SetCollation(collation))
+		if err != nil {
+			return err
+		}
+		if result.MatchedCount == 0 {
+			manyErrs = []ErrorPlus{ErrNotFound}
+			return manyErrs[0]
+		}
+
+		// Read again (after restore)
+		err = mc.Collection(addrObject).FindOne(sessCtx, excludeSoftDeleted(addrObject, queryOne), options.FindOne().SetCollation(collation)).Decode(addrObject)
+		if err == mongo.ErrNoDocuments {
+			manyErrs = []ErrorPlus{ErrNotFound}
+			return manyErrs[0]
+		}
+		if err != nil {
+			return err
+		}
+		if err = decryptFields(addrObject); err != nil {
+			return err
+		}
+
+		// Audit trail
+		if audited && before != nil {
+			after, err := mc.auditSnapshot(sessCtx, addrObject, bson.M{"_id": before["_id"]})
+			if err != nil {
+				return err
+			}
+			return mc.audit(sessCtx, addrObject, "restore", before, after)
 		}
 
 		return nil
@@ -402,7 +909,7 @@ func (mc *MongoConnect) UpdateForm(addrObject interface{}, queryOne interface{},
 	if len(sessCtx) > 0 {
 		err = fn(sessCtx[0])
 	} else {
-		err = mc.Transactionally(fn)
+		err = mc.TransactionallyCtx(ctx, fn)
 	}
 
 	if err != nil {
@@ -415,3 +922,296 @@ func (mc *MongoConnect) UpdateForm(addrObject interface{}, queryOne interface{},
 
 	return []ErrorPlus{}
 }
+
+func (mc *MongoConnect) UpsertForm(addrObject interface{}, queryOne interface{}, inputs Map, sessCtx ...mongo.SessionContext) []ErrorPlus {
+	return mc.UpsertFormCtx(context.Background(), addrObject, queryOne, inputs, sessCtx...)
+}
+
+// Updates the document matching queryOne (with update rules),
+// or creates it (with insert rules) if there is none. Equality
+// fields of queryOne (_id included) become part of a created
+// document. The write is a single upsert, so concurrent upserts
+// never create more than one document.
+//
+// Versioned documents are updated when inputs carry the version
+// (ErrConflict if it is stale), and created when they don't
+func (mc *MongoConnect) UpsertFormCtx(ctx context.Context, addrObject interface{}, queryOne interface{}, inputs Map, sessCtx ...mongo.SessionContext) []ErrorPlus {
+
+	mc = mc.forModel(addrObject)
+
+	w := upsertDocument(addrObject, queryOne, inputs)
+	if len(w.insertErrs) > 0 && len(w.updateErrs) > 0 {
+		// Errors of whichever applies
+		count, err := mc.Collection(addrObject).CountDocuments(ctx, excludeSoftDeleted(addrObject, queryOne), options.Count().SetCollation(queryCollation(addrObject, QueryOptions{})))
+		if err != nil {
+			return []ErrorPlus{{Message: err.Error()}}
+		}
+		if count == 0 {
+			return w.insertErrs
+		}
+		return w.updateErrs
+	}
+	taken, err := uniqueErrors(addrObject, w.data, queryOne, mc.uniqueCounter(ctx, addrObject))
+	if err != nil {
+		return []ErrorPlus{{Message: err.Error()}}
+	}
+	if len(taken) > 0 {
+		return taken
+	}
+	defer mc.cacheInvalidate(addrObject, sessCtx...)
+
+	queryOne = excludeSoftDeleted(addrObject, queryOne)
+	collation := queryCollation(addrObject, QueryOptions{})
+	coll := MongoCollectionName(addrObject)
+	smFields := StateMachine{}.GetStateMachineFieldNames(addrObject)
+	smFieldChanged := false
+	for _, f := range smFields {
+		if inputs.HasKey(f) {
+			smFieldChanged = true
+			break
+		}
+	}
+
+	var manyErrs []ErrorPlus
+	audited := isAudited(addrObject)
+
+	fn := func(sessCtx mongo.SessionContext) error {
+
+		// Referenced documents must exist
+		refErrs, err := refErrors(mc.refFetcher(sessCtx), addrObject, w.data)
+		if err != nil {
+			return err
+		}
+		if len(refErrs[0]) > 0 {
+			manyErrs = refErrs[0]
+			return manyErrs[0]
+		}
+
+		// Document as it was, if there is one (for audit trail
+		// and state transitions)
+		var before bson.M
+		if audited {
+			if before, err = mc.auditSnapshot(sessCtx, addrObject, queryOne); err != nil {
+				return err
+			}
+		}
+		var smPreValues map[string]string
+		if smFieldChanged {
+			pre := reflect.New(TypeDereference(TypeOf(addrObject))).Interface()
+			err := mc.Collection(addrObject).FindOne(sessCtx, queryOne, options.FindOne().SetCollation(collation)).Decode(pre)
+			if err == nil {
+				err = decryptFields(pre)
+			}
+			if err == nil {
+				smPreValues, err = stateMachineValues(pre, smFields)
+			}
+			if err != nil && err != mongo.ErrNoDocuments {
+				return err
+			}
+		}
+
+		// Upsert
+		result, err := mc.Collection(addrObject).UpdateOne(sessCtx, w.filter, w.update, options.Update().SetUpsert(w.upsert).SetCollation(collation))
+		if err != nil {
+			return err
+		}
+		inserted := result.UpsertedID != nil
+		switch {
+		case !inserted && result.MatchedCount == 0:
+			// Not there, and can't be created; or its version is stale
+			count, err := mc.Collection(addrObject).CountDocuments(sessCtx, queryOne, options.Count().SetCollation(collation))
+			if err != nil {
+				return err
+			}
+			if count == 0 {
+				manyErrs = w.insertErrs
+			} else {
+				manyErrs = []ErrorPlus{ErrConflict}
+			}
+			return manyErrs[0]
+		case !inserted && len(w.updateErrs) > 0:
+			// There, but can't be updated (and wasn't)
+			manyErrs = w.updateErrs
+			return manyErrs[0]
+		}
+
+		// Read again (after write)
+		readOne := queryOne
+		if inserted {
+			readOne = bson.M{"_id": result.UpsertedID}
+		}
+		err = mc.Collection(addrObject).FindOne(sessCtx, readOne, options.FindOne().SetCollation(collation)).Decode(addrObject)
+		if err == nil {
+			err = decryptFields(addrObject)
+		}
+		if err != nil {
+			return err
+		}
+
+		// Validate post writing to DB
+		manyErrs = ModelValidateObject(addrObject)
+		if len(manyErrs) > 0 {
+			return manyErrs[0]
+		}
+		if smFieldChanged && !inserted {
+			if err = checkStateTransitions(coll, smFields, smPreValues, addrObject); err != nil {
+				return err
+			}
+		}
+
+		// Audit trail
+		if audited {
+			after, err := mc.auditSnapshot(sessCtx, addrObject, readOne)
+			if err != nil {
+				return err
+			}
+			if inserted {
+				return mc.audit(sessCtx, addrObject, "insert", nil, after)
+			}
+			return mc.audit(sessCtx, addrObject, "update", before, after)
+		}
+
+		return nil
+	}
+
+	// If there is already a context available
+	// then run it under it.
+	// Otherwise, start a new transaction.
+	if len(sessCtx) > 0 {
+		err = fn(sessCtx[0])
+	} else {
+		err = mc.TransactionallyCtx(ctx, fn)
+	}
+
+	if err != nil {
+		if manyErrs != nil && len(manyErrs) > 0 && manyErrs[0] == err {
+			return manyErrs
+		} else {
+			return writeErrorPlus(addrObject, err)
+		}
+	}
+
+	return []ErrorPlus{}
+}
+
+// Single write of an UpsertForm. $set holds the inputs as
+// validated for an update, and $setOnInsert what insert rules
+// add to a new document (defaults, auto fields, initial state,
+// version etc). A side whose rules fail is left out: the upsert
+// then neither updates, nor (upsert being off) creates
+type upsertWrite struct {
+	filter     interface{}
+	update     bson.M
+	upsert     bool
+	insertErrs []ErrorPlus // should the document be new
+	updateErrs []ErrorPlus // should the document exist
+	data       Map         // values written, either way
+}
+
+func upsertDocument(addrObject interface{}, queryOne interface{}, inputs Map) upsertWrite {
+
+	query := upsertQueryFields(queryOne)
+
+	// Validations change the maps they are given
+	insert := inputs.DeepClone()
+	for k, v := range query {
+		if k != "_id" && !insert.HasKey(k) {
+			insert[k] = v
+		}
+	}
+	update := inputs.DeepClone()
+
+	w := upsertWrite{
+		filter:     excludeSoftDeleted(addrObject, queryOne),
+		update:     bson.M{},
+		insertErrs: ModelValidateInputs(addrObject, DB_INSERT, insert),
+		updateErrs: ModelValidateInputs(addrObject, DB_UPDATE, update),
+		data:       Map{},
+	}
+	// A version refers to a document that exists
+	if isVersioned(addrObject) && inputs.HasKey("version") {
+		w.insertErrs = []ErrorPlus{ErrNotFound}
+	}
+	w.upsert = len(w.insertErrs) == 0
+
+	set := Map{}
+	if len(w.updateErrs) == 0 {
+		w.filter, w.update = updateDocument(addrObject, w.filter, update)
+		set = w.update["$set"].(Map)
+	}
+	if w.upsert {
+		onInsert := Map{}
+		for k, v := range insert {
+			if _, inSet := set[k]; inSet {
+				continue
+			}
+			// _id comes from the query, if it has one
+			if _, inQuery := query[k]; inQuery && k == "_id" {
+				continue
+			}
+			onInsert[k] = v
+		}
+		w.update["$setOnInsert"] = onInsert
+		for k, v := range onInsert {
+			w.data[k] = v
+		}
+	}
+	for k, v := range set {
+		w.data[k] = v
+	}
+
+	return w
+}
+
+// Plain equality fields of a query (no operators)
+func upsertQueryFields(query interface{}) Map {
+	output := NewMap()
+
+	fields := Map{}
+	switch q := query.(type) {
+	case bson.D:
+		fields = NewMapFromBsonDoc(q)
+	case bson.M:
+		fields = NewMapFromGoMap(q)
+	case Map:
+		fields = q
+	case map[string]interface{}:
+		fields = NewMapFromGoMap(q)
+	}
+
+	for k, v := range fields {
+		if strings.HasPrefix(k, "$") {
+			continue
+		}
+		if isOperatorDoc(v) {
+			continue
+		}
+		output[k] = v
+	}
+
+	return output
+}
+
+func isOperatorDoc(v interface{}) bool {
+	var keys []string
+	switch d := v.(type) {
+	case bson.M:
+		for k := range d {
+			keys = append(keys, k)
+		}
+	case map[string]interface{}:
+		for k := range d {
+			keys = append(keys, k)
+		}
+	case bson.D:
+		for _, e := range d {
+			keys = append(keys, e.Key)
+		}
+	}
+	for _, k := range keys {
+		if strings.HasPrefix(k, "$") {
+			return true
+		}
+	}
+	return false
+}
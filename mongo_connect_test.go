@@ -0,0 +1,108 @@
+package do
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+func TestUpsertQueryFields(t *testing.T) {
+
+	// Equality fields are carried into created documents,
+	// but not operators
+	m := upsertQueryFields(bson.D{
+		{Key: "_id", Value: "abc"},
+		{Key: "email", Value: "a@b.com"},
+		{Key: "age", Value: bson.M{"$gt": 5}},
+		{Key: "$or", Value: bson.A{}},
+		{Key: "address", Value: bson.M{"city": "pune"}},
+	})
+	assert.Equal(t, Map{"_id": "abc", "email": "a@b.com", "address": bson.M{"city": "pune"}}, m)
+
+	// Unknown query types give nothing
+	assert.Equal(t, Map{}, upsertQueryFields("abc"))
+}
+
+func TestUpdateDocument(t *testing.T) {
+
+	type versioned struct {
+		MongoEntity
+		Versioned `bson:"inline"`
+	}
+
+	// Version moves from $set to the filter, without
+	// touching the inputs
+	inputs := Map{"version": 3, "name": "abc"}
+	filter, update := updateDocument(versioned{}, bson.M{"_id": "x"}, inputs)
+	assert.Equal(t, bson.M{"$and": bson.A{bson.M{"_id": "x"}, bson.M{"version": 3}}}, filter)
+	assert.Equal(t, bson.M{"$set": Map{"name": "abc"}, "$inc": bson.M{"version": 1}}, update)
+	assert.Equal(t, Map{"version": 3, "name": "abc"}, inputs)
+
+	// Always an operator document
+	_, update = updateDocument(versioned{}, bson.M{"_id": "x"}, Map{"version": 3})
+	assert.Equal(t, bson.M{"$set": Map{}, "$inc": bson.M{"version": 1}}, update)
+
+	_, update = updateDocument(struct{ MongoEntity }{}, bson.M{"_id": "x"}, Map{})
+	assert.Equal(t, bson.M{"$set": Map{}}, update)
+}
+
+func TestUpsertDocument(t *testing.T) {
+
+	// One write: update rules in $set, what insert rules
+	// add in $setOnInsert, _id left to the query
+	w := upsertDocument(&memAccount{}, bson.M{"_id": "a-1"}, Map{"email": "a@b.com"})
+	assert.True(t, w.upsert)
+	assert.Equal(t, "version", w.updateErrs[0].Source)
+	_, hasSet := w.update["$set"]
+	assert.False(t, hasSet)
+	onInsert := w.update["$setOnInsert"].(Map)
+	assert.Equal(t, "a@b.com", onInsert["email"])
+	assert.Equal(t, "free", onInsert["plan"])
+	assert.Equal(t, 1, onInsert["version"])
+	assert.False(t, onInsert.HasKey("_id"))
+
+	// Given the version, the document must exist
+	inputs := Map{"logins": "2", "version": "3"}
+	w = upsertDocument(&memAccount{}, bson.M{"email": "a@b.com"}, inputs)
+	assert.False(t, w.upsert)
+	assert.Equal(t, bson.M{"$and": bson.A{bson.M{"email": "a@b.com"}, bson.M{"version": 3}}}, w.filter)
+	assert.Equal(t, bson.M{"$set": Map{"logins": 2}, "$inc": bson.M{"version": 1}}, w.update)
+	assert.Equal(t, Map{"logins": "2", "version": "3"}, inputs)
+
+	// Fields set either way are only in $set
+	w = upsertDocument(struct {
+		MongoEntity
+		Name string `bson:"name" json:"name"`
+		Kind string `bson:"kind" json:"kind" default:"x"`
+	}{}, bson.M{"name": "abc"}, Map{"kind": "y"})
+	assert.True(t, w.upsert)
+	assert.Equal(t, bson.M{"$set": Map{"kind": "y"}, "$setOnInsert": Map{"name": "abc"}}, w.update)
+}
+
+type optionedModel struct{}
+
+func (optionedModel) MongoOptions() MongoModelOptions {
+	return MongoModelOptions{
+		ReadPreference: readpref.SecondaryPreferred(),
+		Collation:      &options.Collation{Locale: "en", Strength: 2},
+	}
+}
+
+func TestMongoOptions(t *testing.T) {
+
+	// Declared by the model, on value or address
+	assert.Equal(t, "secondaryPreferred", MongoOptions(optionedModel{}).ReadPreference.Mode().String())
+	assert.NotNil(t, MongoOptions(&optionedModel{}))
+
+	// Models without the method, and collection names
+	assert.Nil(t, MongoOptions(struct{}{}))
+	assert.Nil(t, MongoOptions("orders"))
+
+	// Collation of the query wins over that of the model
+	assert.Equal(t, "en", queryCollation(optionedModel{}, QueryOptions{}).Locale)
+	assert.Equal(t, "fr", queryCollation(optionedModel{}, QueryOptions{Collation: &options.Collation{Locale: "fr"}}).Locale)
+	assert.Nil(t, queryCollation(struct{}{}, QueryOptions{}))
+}
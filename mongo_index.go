@@ -0,0 +1,308 @@
+package do
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+	INDEXES
+
+	index: true | yes
+		asc (default) | desc | text | 2dsphere
+		unique
+		sparse
+		expire=30d (d/h/m/s)
+		name=... (fields sharing a name make a compound index)
+
+	Options are separated by ;
+	e.g. index:"unique;desc;name=email_created"
+*/
+
+type MongoIndex struct {
+	Collection string
+	Name       string
+	Keys       bson.D
+	Unique     bool
+	Sparse     bool
+	Expire     time.Duration
+}
+
+func (mi MongoIndex) model() mongo.IndexModel {
+	opts := options.Index().SetName(mi.Name)
+	if mi.Unique {
+		opts.SetUnique(true)
+	}
+	if mi.Sparse {
+		opts.SetSparse(true)
+	}
+	if mi.Expire > 0 {
+		opts.SetExpireAfterSeconds(int32(mi.Expire / time.Second))
+	}
+	return mongo.IndexModel{Keys: mi.Keys, Options: opts}
+}
+
+// Creates the indexes declared (using index tag) on the given
+// models. Creation is idempotent. Indexes found in DB, but not
+// declared in code are returned (so that they may be reviewed)
+func (mc *MongoConnect) EnsureIndexes(models ...interface{}) ([]MongoIndex, error) {
+	return mc.EnsureIndexesCtx(context.Background(), models...)
+}
+
+func (mc *MongoConnect) EnsureIndexesCtx(ctx context.Context, models ...interface{}) ([]MongoIndex, error) {
+
+	extra := []MongoIndex{}
+
+	for _, model := range models {
+		declared, err := ModelIndexes(model)
+		if err != nil {
+			return nil, err
+		}
+
+		coll := mc.Collection(model)
+		if len(declared) > 0 {
+			idx := make([]mongo.IndexModel, len(declared))
+			for i := range declared {
+				idx[i] = declared[i].model()
+			}
+			if _, err = coll.Indexes().CreateMany(ctx, idx); err != nil {
+				return nil, err
+			}
+		}
+
+		// Report indexes that are not (or no longer) in code
+		found, err := coll.Indexes().List(ctx)
+		if err != nil {
+			return nil, err
+		}
+		existing := []bson.M{}
+		if err = found.All(ctx, &existing); err != nil {
+			return nil, err
+		}
+
+		known := map[string]bool{"_id_": true}
+		for _, d := range declared {
+			known[d.Name] = true
+		}
+		for _, e := range existing {
+			name, _ := e["name"].(string)
+			if !known[name] {
+				extra = append(extra, MongoIndex{Collection: coll.Name(), Name: name})
+			}
+		}
+	}
+
+	return extra, nil
+}
+
+// Returns indexes declared on a model using the index tag
+func ModelIndexes(model interface{}) ([]MongoIndex, error) {
+
+	fields, err := indexFields(TypeDereference(TypeOf(model)), "")
+	if err != nil {
+		return nil, err
+	}
+
+	// Group fields by index name (or by key, if unnamed).
+	// A collection can have one text index only, so all
+	// unnamed text fields go into the same index
+	groups := map[string]*MongoIndex{}
+	order := []string{}
+	for _, f := range fields {
+		group := f.name
+		if group == "" {
+			group = "$" + f.key
+			if f.kind == "text" {
+				group = "$text"
+			}
+		}
+
+		idx, ok := groups[group]
+		if !ok {
+			idx = &MongoIndex{Collection: MongoCollectionName(model), Name: f.name}
+			groups[group] = idx
+			order = append(order, group)
+		}
+		idx.Keys = append(idx.Keys, bson.E{Key: f.key, Value: f.value()})
+		idx.Unique = idx.Unique || f.unique
+		idx.Sparse = idx.Sparse || f.sparse
+		if f.expire > 0 {
+			idx.Expire = f.expire
+		}
+	}
+
+	output := make([]MongoIndex, 0, len(order))
+	for _, g := range order {
+		idx := groups[g]
+		if idx.Name == "" {
+			idx.Name = defaultIndexName(idx.Keys)
+		}
+		if idx.Expire > 0 && len(idx.Keys) > 1 {
+			return nil, fmt.Errorf("index %s: expire is supported on single field indexes only", idx.Name)
+		}
+		output = append(output, *idx)
+	}
+
+	// Stable output, irrespective of map ordering
+	sort.SliceStable(output, func(i, j int) bool {
+		return output[i].Name < output[j].Name
+	})
+
+	return output, nil
+}
+
+// Same naming scheme as MongoDB uses: key_value_key_value
+func defaultIndexName(keys bson.D) string {
+	parts := []string{}
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s_%v", k.Key, k.Value))
+	}
+	return strings.Join(parts, "_")
+}
+
+type indexField struct {
+	key    string
+	kind   string // asc | desc | text | 2dsphere
+	name   string
+	unique bool
+	sparse bool
+	expire time.Duration
+}
+
+func (f indexField) value() interface{} {
+	switch f.kind {
+	case "desc":
+		return -1
+	case "text", "2dsphere":
+		return f.kind
+	}
+	return 1
+}
+
+func indexFields(t reflect.Type, prefix string) ([]indexField, error) {
+	output := []indexField{}
+
+	if t.Kind() != reflect.Struct {
+		return output, nil
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		fld := t.Field(i)
+		key, inline := bsonFieldKey(fld)
+		if key == "-" {
+			continue
+		}
+		if prefix != "" && !inline {
+			key = prefix + "." + key
+		}
+
+		// Structs are walked, unless indexed themselves
+		// (as is the case with 2dsphere on geo json)
+		ft := TypeDereference(fld.Type)
+		if ft.Kind() == reflect.Struct && !TypeIsTime(ft) && fld.Tag.Get("index") == "" {
+			sub := key
+			if inline {
+				sub = prefix
+			}
+			nested, err := indexFields(ft, sub)
+			if err != nil {
+				return nil, err
+			}
+			output = append(output, nested...)
+			continue
+		}
+
+		f, err := parseIndexTag(fld.Tag.Get("index"))
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %s", fld.Name, err.Error())
+		}
+		if f != nil {
+			// Encrypted fields are indexed by their blind index
+			if et, encrypted := parseEncryptTag(fld, WalkConfig{"json"}.FieldKey(fld)); encrypted {
+				if et.blind == "" {
+					return nil, fmt.Errorf("field %s: encrypted fields can only be indexed through a blind index", fld.Name)
+				}
+				key = et.blind
+				if prefix != "" {
+					key = prefix + "." + key
+				}
+			}
+			f.key = key
+			output = append(output, *f)
+		}
+	}
+
+	return output, nil
+}
+
+// Name of a field as stored in DB. Embedded structs and
+// those tagged inline do not add a level of nesting
+func bsonFieldKey(fld reflect.StructField) (string, bool) {
+	tag := fld.Tag.Get("bson")
+	name := strings.Split(tag, ",")[0]
+	if name == "inline" || strings.Contains(tag, ",inline") || (fld.Anonymous && name == "") {
+		return "", true
+	}
+	if name != "" {
+		return name, false
+	}
+	return WalkConfig{"json"}.FieldKey(fld), false
+}
+
+func parseIndexTag(tag string) (*indexField, error) {
+	tag = strings.TrimSpace(tag)
+	if tag == "" || tag == "false" || tag == "no" {
+		return nil, nil
+	}
+
+	f := indexField{kind: "asc"}
+	for _, part := range strings.Split(tag, ";") {
+		part = strings.TrimSpace(part)
+		switch {
+		case part == "true" || part == "yes" || part == "":
+		case part == "asc" || part == "desc" || part == "text" || part == "2dsphere":
+			f.kind = part
+		case part == "unique":
+			f.unique = true
+		case part == "sparse":
+			f.sparse = true
+		case strings.HasPrefix(part, "name="):
+			f.name = part[5:]
+		case strings.HasPrefix(part, "expire="):
+			d, err := parseExpire(part[7:])
+			if err != nil {
+				return nil, err
+			}
+			f.expire = d
+		default:
+			return nil, fmt.Errorf("unsupported index option: %s", part)
+		}
+	}
+
+	return &f, nil
+}
+
+// 30d, 12h, 15m, 45s
+func parseExpire(str string) (time.Duration, error) {
+	if strings.HasSuffix(str, "d") {
+		days := ParseIntOr(strings.TrimSuffix(str, "d"), -1)
+		if days < 0 {
+			return 0, fmt.Errorf("invalid expire: %s", str)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+
+	d, err := time.ParseDuration(str)
+	if err != nil || d < time.Second {
+		return 0, fmt.Errorf("invalid expire: %s", str)
+	}
+	return d, nil
+}
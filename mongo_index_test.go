@@ -0,0 +1,85 @@
+package do
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestParseIndexTag(t *testing.T) {
+
+	{
+		f, err := parseIndexTag("true")
+		assert.Nil(t, err)
+		assert.Equal(t, 1, f.value())
+	}
+
+	{
+		f, err := parseIndexTag("desc;unique;sparse;name=abc")
+		assert.Nil(t, err)
+		assert.Equal(t, -1, f.value())
+		assert.True(t, f.unique)
+		assert.True(t, f.sparse)
+		assert.Equal(t, "abc", f.name)
+	}
+
+	{
+		f, err := parseIndexTag("expire=30d")
+		assert.Nil(t, err)
+		assert.Equal(t, 30*24*time.Hour, f.expire)
+	}
+
+	{
+		f, err := parseIndexTag("no")
+		assert.Nil(t, err)
+		assert.Nil(t, f)
+	}
+
+	{
+		_, err := parseIndexTag("bogus")
+		assert.NotNil(t, err)
+	}
+}
+
+func TestModelIndexes(t *testing.T) {
+
+	type model struct {
+		MongoEntity
+		Email   string `bson:"email" json:"email" index:"unique"`
+		First   string `bson:"first" json:"first" index:"name=full_name"`
+		Last    string `bson:"last" json:"last" index:"desc;name=full_name"`
+		Bio     string `bson:"bio" json:"bio" index:"text"`
+		Address struct {
+			City string `bson:"city" json:"city" index:"true"`
+		} `bson:"address" json:"address"`
+		Timed `bson:"inline"`
+	}
+
+	idx, err := ModelIndexes(model{})
+	assert.Nil(t, err)
+
+	names := []string{}
+	for _, i := range idx {
+		names = append(names, i.Name)
+	}
+	assert.Equal(t, []string{"address.city_1", "bio_text", "created_at_1", "email_1", "full_name", "updated_at_1"}, names)
+
+	for _, i := range idx {
+		switch i.Name {
+		case "email_1":
+			assert.True(t, i.Unique)
+		case "full_name":
+			assert.Equal(t, bson.D{{Key: "first", Value: 1}, {Key: "last", Value: -1}}, i.Keys)
+		}
+	}
+
+	// expire cannot be part of a compound index
+	type bad struct {
+		A time.Time `index:"expire=1h;name=x"`
+		B string    `index:"name=x"`
+	}
+	_, err = ModelIndexes(bad{})
+	assert.NotNil(t, err)
+}
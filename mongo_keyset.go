@@ -0,0 +1,280 @@
+package do
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"reflect"
+	"strings"
+
+	"github.com/rightjoin/fig"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+	KEYSET PAGINATION
+
+	Instead of skip/limit, pages are located using the values
+	of the sort keys of the last (or first) document of the
+	previous page. The values are handed to clients as an opaque
+	cursor. _id is always added as the last sort key, so that
+	the order is total.
+*/
+
+// Query (skip / limit based) can't page by keyset cursors
+var errKeysetCursor = errors.New("After and Before are keyset cursors, see QueryKeyset")
+
+func (mc *MongoConnect) QueryKeyset(model interface{}, addrSlice interface{}, opts ...QueryOptions) (next string, prev string, err error) {
+	return mc.QueryKeysetCtx(context.Background(), model, addrSlice, opts...)
+}
+
+// Reads one page (of opt.Chunk documents) after opt.After
+// or before opt.Before, and returns cursors to the next and
+// previous pages. A cursor is empty when there is no such page
+func (mc *MongoConnect) QueryKeysetCtx(ctx context.Context, model interface{}, addrSlice interface{}, opts ...QueryOptions) (next string, prev string, err error) {
+
+	mc = mc.forModel(model)
+
+	ctx, cancel := mc.timeout(ctx, "query")
+	defer cancel()
+
+	var opt = QueryOptions{
+		Query: bson.D{},
+		Sort:  bson.D{},
+	}
+	if len(opts) != 0 {
+		opt = opts[0]
+	}
+
+	// Leave out soft deleted documents, unless asked for
+	if !opt.WithDeleted {
+		opt.Query = excludeSoftDeleted(model, opt.Query)
+	}
+
+	max := fig.IntOr(25, "pagination.chunk")
+	if opt.Chunk < 1 || opt.Chunk > max {
+		opt.Chunk = max
+	}
+
+	sort, err := keysetSort(opt.Sort)
+	if err != nil {
+		return "", "", err
+	}
+
+	// Walking backwards is the same as walking forward
+	// with all sort directions reversed
+	backward := opt.Before != ""
+	cursor := opt.After
+	if backward {
+		cursor = opt.Before
+		sort = keysetReverse(sort)
+	}
+
+	query := opt.Query
+	if cursor != "" {
+		values, err := keysetDecode(cursor, len(sort))
+		if err != nil {
+			return "", "", err
+		}
+		query = bson.M{"$and": bson.A{opt.Query, keysetFilter(sort, values)}}
+	}
+
+	// Fetch one extra document to know if there are more
+	coll, err := mc.queryCollection(model, opt)
+	if err != nil {
+		return "", "", err
+	}
+	found, err := coll.Find(ctx, query, &options.FindOptions{
+		Limit:      P_int64(int64(opt.Chunk + 1)),
+		Sort:       sort,
+		Collation:  queryCollation(model, opt),
+		Projection: keysetProjection(model, opt.Projection, sort),
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	raws := []bson.Raw{}
+	err = found.All(ctx, &raws)
+	if err != nil {
+		return "", "", err
+	}
+
+	more := len(raws) > opt.Chunk
+	if more {
+		raws = raws[:opt.Chunk]
+	}
+	if backward {
+		for i, j := 0, len(raws)-1; i < j; i, j = i+1, j-1 {
+			raws[i], raws[j] = raws[j], raws[i]
+		}
+	}
+
+	if len(raws) > 0 {
+		first := keysetEncode(sort, raws[0])
+		last := keysetEncode(sort, raws[len(raws)-1])
+		if backward {
+			next = last
+			if more {
+				prev = first
+			}
+		} else {
+			if more {
+				next = last
+			}
+			if cursor != "" {
+				prev = first
+			}
+		}
+	}
+
+	if err = decodeRawsInto(raws, addrSlice); err != nil {
+		return "", "", err
+	}
+	return next, prev, populateRefs(mc.refFetcher(ctx), model, addrSlice, opt.Populate)
+}
+
+// Sort must be ordered (bson.D), unless it has a single key.
+// _id gets appended as the tie breaker
+func keysetSort(sort interface{}) (bson.D, error) {
+	output := bson.D{}
+
+	switch s := sort.(type) {
+	case nil:
+	case bson.D:
+		output = append(output, s...)
+	case bson.M:
+		if len(s) > 1 {
+			return nil, errors.New("keyset pagination needs an ordered sort (bson.D)")
+		}
+		for k, v := range s {
+			output = append(output, bson.E{Key: k, Value: v})
+		}
+	default:
+		return nil, errors.New("keyset pagination needs an ordered sort (bson.D)")
+	}
+
+	for i := range output {
+		if keysetDirection(output[i].Value) < 0 {
+			output[i].Value = -1
+		} else {
+			output[i].Value = 1
+		}
+		if output[i].Key == "_id" {
+			return output[:i+1], nil
+		}
+	}
+
+	return append(output, bson.E{Key: "_id", Value: 1}), nil
+}
+
+// Cursors are made of the sort keys, so a projection that
+// includes fields has to include them too
+func keysetProjection(model interface{}, projection bson.M, sort bson.D) bson.M {
+	if projectionIncludes(projection) {
+		with := bson.M{}
+		for k, v := range projection {
+			with[k] = v
+		}
+		for _, e := range sort {
+			with[e.Key] = 1
+		}
+		projection = with
+	}
+	return queryProjection(model, projection)
+}
+
+func keysetDirection(dir interface{}) int {
+	switch d := dir.(type) {
+	case int:
+		return d
+	case int32:
+		return int(d)
+	case int64:
+		return int(d)
+	case float64:
+		return int(d)
+	}
+	return 1
+}
+
+func keysetReverse(sort bson.D) bson.D {
+	output := bson.D{}
+	for _, e := range sort {
+		output = append(output, bson.E{Key: e.Key, Value: -keysetDirection(e.Value)})
+	}
+	return output
+}
+
+// Documents strictly after the given values of sort keys:
+// (k1 > v1) or (k1 = v1 and k2 > v2) or ...
+func keysetFilter(sort bson.D, values bson.A) bson.M {
+	or := bson.A{}
+	for i := range sort {
+		cond := bson.D{}
+		for j := 0; j < i; j++ {
+			cond = append(cond, bson.E{Key: sort[j].Key, Value: values[j]})
+		}
+		op := "$gt"
+		if keysetDirection(sort[i].Value) < 0 {
+			op = "$lt"
+		}
+		cond = append(cond, bson.E{Key: sort[i].Key, Value: bson.M{op: values[i]}})
+		or = append(or, cond)
+	}
+	return bson.M{"$or": or}
+}
+
+func keysetEncode(sort bson.D, doc bson.Raw) string {
+	values := bson.A{}
+	for _, e := range sort {
+		var val interface{}
+		rv, err := doc.LookupErr(strings.Split(e.Key, ".")...)
+		if err == nil {
+			rv.Unmarshal(&val)
+		}
+		values = append(values, val)
+	}
+
+	b, err := bson.Marshal(bson.M{"v": values})
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func keysetDecode(cursor string, count int) (bson.A, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+
+	data := struct {
+		V bson.A `bson:"v"`
+	}{}
+	if err = bson.Unmarshal(b, &data); err != nil || len(data.V) != count {
+		return nil, errors.New("invalid cursor")
+	}
+
+	return data.V, nil
+}
+
+// Decodes raw documents into the slice addrSlice points to
+func decodeRawsInto(raws []bson.Raw, addrSlice interface{}) error {
+	sv := reflect.ValueOf(addrSlice)
+	if sv.Kind() != reflect.Ptr || sv.Elem().Kind() != reflect.Slice {
+		return errors.New("expected address of a slice")
+	}
+	sv = sv.Elem()
+
+	out := reflect.MakeSlice(sv.Type(), len(raws), len(raws))
+	for i, raw := range raws {
+		if err := bson.Unmarshal(raw, out.Index(i).Addr().Interface()); err != nil {
+			return err
+		}
+	}
+	sv.Set(out)
+
+	return decryptFields(addrSlice)
+}
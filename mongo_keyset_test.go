@@ -0,0 +1,63 @@
+package do
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestKeysetSort(t *testing.T) {
+
+	// _id is appended as tie breaker
+	{
+		s, err := keysetSort(bson.D{{Key: "name", Value: -1}})
+		assert.Nil(t, err)
+		assert.Equal(t, bson.D{{Key: "name", Value: -1}, {Key: "_id", Value: 1}}, s)
+	}
+
+	// unless already present
+	{
+		s, err := keysetSort(bson.M{"_id": -1})
+		assert.Nil(t, err)
+		assert.Equal(t, bson.D{{Key: "_id", Value: -1}}, s)
+	}
+
+	// unordered sort with many keys is ambiguous
+	{
+		_, err := keysetSort(bson.M{"a": 1, "b": 1})
+		assert.NotNil(t, err)
+	}
+}
+
+func TestKeysetCursor(t *testing.T) {
+
+	sort := bson.D{{Key: "address.city", Value: 1}, {Key: "_id", Value: 1}}
+	raw, _ := bson.Marshal(bson.M{"_id": "abc", "address": bson.M{"city": "pune"}})
+
+	cursor := keysetEncode(sort, raw)
+	values, err := keysetDecode(cursor, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, bson.A{"pune", "abc"}, values)
+
+	// count must match the sort keys
+	_, err = keysetDecode(cursor, 3)
+	assert.NotNil(t, err)
+
+	_, err = keysetDecode("???", 2)
+	assert.NotNil(t, err)
+
+	assert.Equal(t, bson.M{"$or": bson.A{
+		bson.D{{Key: "address.city", Value: bson.M{"$gt": "pune"}}},
+		bson.D{{Key: "address.city", Value: "pune"}, {Key: "_id", Value: bson.M{"$gt": "abc"}}},
+	}}, keysetFilter(sort, values))
+}
+
+func TestQueryRejectsCursors(t *testing.T) {
+
+	rows := []memTicket{}
+	_, err := (&MongoConnect{}).Query(memTicket{}, &rows, QueryOptions{After: "abc"})
+	assert.Equal(t, errKeysetCursor, err)
+	_, err = NewMemoryStore().Query(memTicket{}, &rows, QueryOptions{Before: "abc"})
+	assert.Equal(t, errKeysetCursor, err)
+}
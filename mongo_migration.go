@@ -0,0 +1,376 @@
+package do
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/logrusorgru/aurora"
+	"github.com/rightjoin/fig"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+	MIGRATIONS
+
+	Migrations are registered (usually from init) with an ID and
+	up / down funcs. IDs are applied in sorted order, so prefix
+	them with a timestamp: 20260101_split_name
+
+	Applied IDs are recorded in the schema_migrations collection.
+	The same collection holds a lock document, so that only one
+	instance runs migrations at a time. The lock is renewed while
+	migrations run
+*/
+
+const migrationColl = "schema_migrations"
+const migrationLockID = "__lock__"
+
+type MigrationFunc func(mc *MongoConnect, sessCtx mongo.SessionContext) error
+
+type Migration struct {
+	ID   string
+	Up   MigrationFunc
+	Down MigrationFunc
+}
+
+type MigrationStatus struct {
+	ID        string     `json:"id"`
+	Applied   bool       `json:"applied"`
+	AppliedAt *time.Time `json:"applied_at"`
+}
+
+type migrationRecord struct {
+	ID        string    `bson:"_id"`
+	AppliedAt time.Time `bson:"applied_at"`
+}
+
+var allMigrations = map[string]Migration{}
+
+func RegisterMigration(m Migration) {
+	if m.ID == "" || m.ID == migrationLockID {
+		panic("invalid migration id: " + m.ID)
+	}
+	if _, found := allMigrations[m.ID]; found {
+		panic("migration registered twice: " + m.ID)
+	}
+	allMigrations[m.ID] = m
+}
+
+func sortedMigrations() []Migration {
+	output := make([]Migration, 0, len(allMigrations))
+	for _, m := range allMigrations {
+		output = append(output, m)
+	}
+	sort.Slice(output, func(i, j int) bool {
+		return output[i].ID < output[j].ID
+	})
+	return output
+}
+
+func (mc *MongoConnect) appliedMigrations(ctx context.Context) (map[string]time.Time, error) {
+	cursor, err := mc.Collection(migrationColl).Find(ctx, bson.M{"_id": bson.M{"$ne": migrationLockID}})
+	if err != nil {
+		return nil, err
+	}
+
+	records := []migrationRecord{}
+	if err = cursor.All(ctx, &records); err != nil {
+		return nil, err
+	}
+
+	output := map[string]time.Time{}
+	for _, r := range records {
+		output[r.ID] = r.AppliedAt
+	}
+	return output, nil
+}
+
+// Where migrations are recorded and locked. MongoConnect keeps
+// them in the schema_migrations collection
+type migrationStore interface {
+	appliedMigrations(ctx context.Context) (map[string]time.Time, error)
+	// Runs the up (or down) func of the migration and records
+	// it as applied (or not), all in one transaction
+	runMigration(m Migration, up bool) error
+	// Takes the lock, unless held by another owner since
+	// staleBefore. Returns errMigrationsLocked if so
+	lockMigrations(owner string, staleBefore time.Time) error
+	// Refreshes the lock, returns false if it is no longer owned
+	renewMigrationLock(owner string) (bool, error)
+	unlockMigrations(owner string) error
+}
+
+var errMigrationsLocked = errors.New("migrations are locked by another instance")
+var errMigrationLockLost = errors.New("migration lock was lost (taken over by another instance)")
+
+// Returns every registered migration, along with whether
+// it has been applied
+func (mc *MongoConnect) MigrateStatus() ([]MigrationStatus, error) {
+	return migrateStatus(mc)
+}
+
+// Applies all pending migrations. Returns IDs of the
+// migrations applied
+func (mc *MongoConnect) MigrateUp() ([]string, error) {
+	return migrateUp(mc, migrationLockStale())
+}
+
+// Rolls back the last steps applied migrations. Returns
+// IDs of the migrations rolled back
+func (mc *MongoConnect) MigrateDown(steps int) ([]string, error) {
+	return migrateDown(mc, steps, migrationLockStale())
+}
+
+func migrateStatus(store migrationStore) ([]MigrationStatus, error) {
+	applied, err := store.appliedMigrations(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	output := []MigrationStatus{}
+	for _, m := range sortedMigrations() {
+		st := MigrationStatus{ID: m.ID}
+		if at, ok := applied[m.ID]; ok {
+			st.Applied = true
+			st.AppliedAt = &at
+		}
+		output = append(output, st)
+	}
+	return output, nil
+}
+
+func migrateUp(store migrationStore, stale time.Duration) ([]string, error) {
+	done := []string{}
+
+	err := withMigrationLock(store, stale, func(held func() error) error {
+		applied, err := store.appliedMigrations(context.Background())
+		if err != nil {
+			return err
+		}
+
+		for _, m := range sortedMigrations() {
+			if _, ok := applied[m.ID]; ok {
+				continue
+			}
+			if m.Up == nil {
+				return fmt.Errorf("migration %s: no up func", m.ID)
+			}
+			if err := held(); err != nil {
+				return err
+			}
+			if err := store.runMigration(m, true); err != nil {
+				return fmt.Errorf("migration %s: %s", m.ID, err.Error())
+			}
+			done = append(done, m.ID)
+		}
+
+		return nil
+	})
+
+	return done, err
+}
+
+func migrateDown(store migrationStore, steps int, stale time.Duration) ([]string, error) {
+	done := []string{}
+
+	err := withMigrationLock(store, stale, func(held func() error) error {
+		applied, err := store.appliedMigrations(context.Background())
+		if err != nil {
+			return err
+		}
+
+		ids := []string{}
+		for id := range applied {
+			ids = append(ids, id)
+		}
+		sort.Sort(sort.Reverse(sort.StringSlice(ids)))
+
+		for i := 0; i < steps && i < len(ids); i++ {
+			m, ok := allMigrations[ids[i]]
+			if !ok || m.Down == nil {
+				return fmt.Errorf("migration %s: no down func", ids[i])
+			}
+			if err := held(); err != nil {
+				return err
+			}
+			if err := store.runMigration(m, false); err != nil {
+				return fmt.Errorf("migration %s: %s", m.ID, err.Error())
+			}
+			done = append(done, m.ID)
+		}
+
+		return nil
+	})
+
+	return done, err
+}
+
+// Entry point for deploy scripts: status | up | down [steps]
+func (mc *MongoConnect) Migrate(args ...string) error {
+
+	cmd := "status"
+	if len(args) > 0 {
+		cmd = args[0]
+	}
+
+	switch cmd {
+	case "status":
+		status, err := mc.MigrateStatus()
+		if err != nil {
+			return err
+		}
+		for _, st := range status {
+			if st.Applied {
+				fmt.Println(aurora.Green("applied"), st.ID, st.AppliedAt.Format(time.RFC3339))
+			} else {
+				fmt.Println(aurora.Yellow("pending"), st.ID)
+			}
+		}
+		return nil
+	case "up":
+		done, err := mc.MigrateUp()
+		for _, id := range done {
+			fmt.Println(aurora.Green("up"), id)
+		}
+		return err
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid steps: %s", args[1])
+			}
+			steps = n
+		}
+		done, err := mc.MigrateDown(steps)
+		for _, id := range done {
+			fmt.Println(aurora.Magenta("down"), id)
+		}
+		return err
+	}
+
+	return fmt.Errorf("unknown migrate command: %s", cmd)
+}
+
+const defaultMigrationLockStale = 600 * time.Second
+
+// A lock not renewed for database.mongo.migrations.lock seconds
+// (600 by default) is considered abandoned and taken over
+func migrationLockStale() time.Duration {
+	return lockStale(fig.IntOr(0, "database.mongo.migrations.lock"))
+}
+
+// Non-positive settings fall back to the default
+func lockStale(seconds int) time.Duration {
+	if seconds <= 0 {
+		return defaultMigrationLockStale
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// Holds the lock while doAction runs, renewing it (every third
+// of the stale period) so that long migrations keep it. doAction
+// calls held before each step, which fails once the lock is lost
+func withMigrationLock(store migrationStore, stale time.Duration, doAction func(held func() error) error) error {
+
+	if stale/3 <= 0 {
+		stale = defaultMigrationLockStale
+	}
+
+	owner := NewUUID()
+	if err := store.lockMigrations(owner, time.Now().Add(-stale)); err != nil {
+		return err
+	}
+	defer store.unlockMigrations(owner)
+
+	var mu sync.Mutex
+	var lost error
+	held := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		return lost
+	}
+
+	stop := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(stale / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				ok, err := store.renewMigrationLock(owner)
+				if err == nil && !ok {
+					mu.Lock()
+					lost = errMigrationLockLost
+					mu.Unlock()
+					return
+				}
+			}
+		}
+	}()
+
+	err := doAction(held)
+	close(stop)
+	<-finished
+	if err == nil {
+		err = held()
+	}
+	return err
+}
+
+func (mc *MongoConnect) runMigration(m Migration, up bool) error {
+	return mc.Transactionally(func(sessCtx mongo.SessionContext) error {
+		if up {
+			if err := m.Up(mc, sessCtx); err != nil {
+				return err
+			}
+			_, err := mc.Collection(migrationColl).InsertOne(sessCtx, migrationRecord{ID: m.ID, AppliedAt: time.Now()})
+			return err
+		}
+
+		if err := m.Down(mc, sessCtx); err != nil {
+			return err
+		}
+		_, err := mc.Collection(migrationColl).DeleteOne(sessCtx, bson.M{"_id": m.ID})
+		return err
+	})
+}
+
+func (mc *MongoConnect) lockMigrations(owner string, staleBefore time.Time) error {
+	_, err := mc.Collection(migrationColl).UpdateOne(context.Background(),
+		bson.M{"_id": migrationLockID, "locked_at": bson.M{"$lt": staleBefore}},
+		bson.M{"$set": bson.M{"locked_at": time.Now(), "owner": owner}},
+		options.Update().SetUpsert(true),
+	)
+	if mongo.IsDuplicateKeyError(err) {
+		return errMigrationsLocked
+	}
+	return err
+}
+
+func (mc *MongoConnect) renewMigrationLock(owner string) (bool, error) {
+	result, err := mc.Collection(migrationColl).UpdateOne(context.Background(),
+		bson.M{"_id": migrationLockID, "owner": owner},
+		bson.M{"$set": bson.M{"locked_at": time.Now()}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount == 1, nil
+}
+
+func (mc *MongoConnect) unlockMigrations(owner string) error {
+	_, err := mc.Collection(migrationColl).DeleteOne(context.Background(), bson.M{"_id": migrationLockID, "owner": owner})
+	return err
+}
@@ -0,0 +1,195 @@
+package do
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Migrations recorded and locked in memory
+type memoryMigrations struct {
+	mu       sync.Mutex
+	applied  map[string]time.Time
+	owner    string
+	lockedAt time.Time
+	renewals int
+}
+
+func (mm *memoryMigrations) appliedMigrations(ctx context.Context) (map[string]time.Time, error) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	output := map[string]time.Time{}
+	for id, at := range mm.applied {
+		output[id] = at
+	}
+	return output, nil
+}
+
+func (mm *memoryMigrations) runMigration(m Migration, up bool) error {
+	if up {
+		if err := m.Up(nil, nil); err != nil {
+			return err
+		}
+		mm.mu.Lock()
+		mm.applied[m.ID] = time.Now()
+		mm.mu.Unlock()
+		return nil
+	}
+	if err := m.Down(nil, nil); err != nil {
+		return err
+	}
+	mm.mu.Lock()
+	delete(mm.applied, m.ID)
+	mm.mu.Unlock()
+	return nil
+}
+
+func (mm *memoryMigrations) lockMigrations(owner string, staleBefore time.Time) error {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	if mm.owner != "" && !mm.lockedAt.Before(staleBefore) {
+		return errMigrationsLocked
+	}
+	mm.owner = owner
+	mm.lockedAt = time.Now()
+	return nil
+}
+
+func (mm *memoryMigrations) renewMigrationLock(owner string) (bool, error) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	if mm.owner != owner {
+		return false, nil
+	}
+	mm.lockedAt = time.Now()
+	mm.renewals++
+	return true, nil
+}
+
+func (mm *memoryMigrations) unlockMigrations(owner string) error {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	if mm.owner == owner {
+		mm.owner = ""
+	}
+	return nil
+}
+
+func TestMigrations(t *testing.T) {
+
+	saved := allMigrations
+	allMigrations = map[string]Migration{}
+	defer func() { allMigrations = saved }()
+
+	ran := []string{}
+	step := func(name string) MigrationFunc {
+		return func(*MongoConnect, mongo.SessionContext) error {
+			ran = append(ran, name)
+			return nil
+		}
+	}
+
+	// Applied in sorted order, whatever the order of registration
+	RegisterMigration(Migration{ID: "20260102_b", Up: step("up b"), Down: step("down b")})
+	RegisterMigration(Migration{ID: "20260101_a", Up: step("up a"), Down: step("down a")})
+	RegisterMigration(Migration{ID: "20260103_c", Up: step("up c")})
+	assert.Panics(t, func() { RegisterMigration(Migration{ID: "20260101_a"}) })
+	assert.Panics(t, func() { RegisterMigration(Migration{ID: migrationLockID}) })
+
+	mm := &memoryMigrations{applied: map[string]time.Time{}}
+
+	status, err := migrateStatus(mm)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(status))
+	assert.Equal(t, "20260101_a", status[0].ID)
+	assert.False(t, status[0].Applied)
+
+	done, err := migrateUp(mm, time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"20260101_a", "20260102_b", "20260103_c"}, done)
+	assert.Equal(t, []string{"up a", "up b", "up c"}, ran)
+	assert.Equal(t, "", mm.owner)
+
+	// Nothing left to apply
+	done, _ = migrateUp(mm, time.Minute)
+	assert.Equal(t, 0, len(done))
+
+	status, _ = migrateStatus(mm)
+	assert.True(t, status[2].Applied)
+	assert.NotNil(t, status[2].AppliedAt)
+
+	// Rolled back latest first; c has no down func
+	ran = nil
+	_, err = migrateDown(mm, 1, time.Minute)
+	assert.NotNil(t, err)
+	delete(mm.applied, "20260103_c")
+	done, err = migrateDown(mm, 2, time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"20260102_b", "20260101_a"}, done)
+	assert.Equal(t, []string{"down b", "down a"}, ran)
+
+	// Failing migrations stop the run
+	allMigrations["20260104_d"] = Migration{ID: "20260104_d", Up: func(*MongoConnect, mongo.SessionContext) error {
+		return errors.New("boom")
+	}}
+	done, err = migrateUp(mm, time.Minute)
+	assert.Equal(t, "migration 20260104_d: boom", err.Error())
+	assert.Equal(t, 3, len(done))
+}
+
+func TestMigrationLock(t *testing.T) {
+
+	mm := &memoryMigrations{applied: map[string]time.Time{}}
+	stale := 60 * time.Millisecond
+
+	// Held (and renewed) for as long as the action runs
+	started := make(chan bool)
+	release := make(chan bool)
+	result := make(chan error)
+	go func() {
+		result <- withMigrationLock(mm, stale, func(held func() error) error {
+			started <- true
+			<-release
+			return held()
+		})
+	}()
+	<-started
+	time.Sleep(3 * stale)
+	assert.Equal(t, errMigrationsLocked, withMigrationLock(mm, stale, func(func() error) error { return nil }))
+	release <- true
+	assert.Nil(t, <-result)
+	assert.True(t, mm.renewals > 0)
+
+	// Released afterwards
+	assert.Nil(t, withMigrationLock(mm, stale, func(func() error) error { return nil }))
+
+	// An abandoned lock is taken over, and its (late)
+	// owner learns it lost the lock
+	mm.owner = "crashed"
+	mm.lockedAt = time.Now().Add(-time.Hour)
+	assert.Nil(t, withMigrationLock(mm, stale, func(func() error) error { return nil }))
+
+	err := withMigrationLock(mm, stale, func(held func() error) error {
+		mm.mu.Lock()
+		mm.owner = "other"
+		mm.mu.Unlock()
+		time.Sleep(stale)
+		return held()
+	})
+	assert.Equal(t, errMigrationLockLost, err)
+}
+
+func TestLockStale(t *testing.T) {
+	assert.Equal(t, 30*time.Second, lockStale(30))
+	assert.Equal(t, defaultMigrationLockStale, lockStale(0))
+	assert.Equal(t, defaultMigrationLockStale, lockStale(-5))
+
+	mm := &memoryMigrations{}
+	assert.Nil(t, withMigrationLock(mm, 0, func(func() error) error { return nil }))
+	assert.Nil(t, withMigrationLock(mm, 2, func(func() error) error { return nil }))
+}
@@ -0,0 +1,250 @@
+package do
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"time"
+
+	"github.com/rightjoin/fig"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+	NAMED CONNECTIONS
+
+	database.mongo:
+		connection: ...            (default connection)
+		db: ...
+		analytics:                 (named connection)
+			connection: mongodb://...
+			db: events
+			app_name: billing
+			pool:
+				max: 100
+				min: 5
+			auth:
+				mechanism: SCRAM-SHA-256 | MONGODB-X509 | ...
+				source: admin
+				username: ...
+				password: ...
+			tls:
+				enabled: true
+				ca_file: /etc/ssl/ca.pem
+				cert_file: /etc/ssl/client.pem (certificate and key)
+				insecure: false
+			timeout:               (milliseconds)
+				connect: 10000
+				server_selection: 30000
+				query / stream / transaction (see timeout)
+
+	The default connection reads the same keys right under
+	database.mongo, so those (and other keys there, such as
+	tenancy or migrations) can't name a connection. Models
+	pick a named connection with a MongoConnection method
+	(see MongoConnectionName).
+
+	Sessions belong to the connection they were started on, so
+	a transaction can't span connections. References to models
+	of another connection are checked (and restrict deletes)
+	outside the transaction, while cascade and set_null on them
+	fail the delete
+*/
+
+type mongoConnConfig struct {
+	Name    string
+	ConnStr string
+	AppName string
+
+	PoolMax int
+	PoolMin int
+
+	AuthMechanism string
+	AuthSource    string
+	Username      string
+	Password      string
+
+	TLS         bool
+	TLSCAFile   string
+	TLSCertFile string
+	TLSInsecure bool
+
+	ConnectTimeout         time.Duration
+	ServerSelectionTimeout time.Duration
+}
+
+// Keys under database.mongo that aren't connections
+var mongoReservedNames = map[string]bool{
+	"connection": true, "db": true, "app_name": true, "pool": true,
+	"auth": true, "tls": true, "timeout": true, "transaction": true,
+	"tenancy": true, "migrations": true, "encryption": true,
+}
+
+// Config key of a connection, e.g. database.mongo.analytics.db
+func mongoConfigKey(name string, key string) string {
+	if name == "" {
+		return "database.mongo." + key
+	}
+	return "database.mongo." + name + "." + key
+}
+
+func mongoConfig(name string, connStr string) mongoConnConfig {
+	key := func(k string) string {
+		return mongoConfigKey(name, k)
+	}
+	return mongoConnConfig{
+		Name:                   name,
+		ConnStr:                connStr,
+		AppName:                fig.StringOr("", key("app_name")),
+		PoolMax:                fig.IntOr(0, key("pool.max")),
+		PoolMin:                fig.IntOr(0, key("pool.min")),
+		AuthMechanism:          fig.StringOr("", key("auth.mechanism")),
+		AuthSource:             fig.StringOr("", key("auth.source")),
+		Username:               fig.StringOr("", key("auth.username")),
+		Password:               fig.StringOr("", key("auth.password")),
+		TLS:                    fig.BoolOr(false, key("tls.enabled")),
+		TLSCAFile:              fig.StringOr("", key("tls.ca_file")),
+		TLSCertFile:            fig.StringOr("", key("tls.cert_file")),
+		TLSInsecure:            fig.BoolOr(false, key("tls.insecure")),
+		ConnectTimeout:         time.Duration(fig.IntOr(0, key("timeout.connect"))) * time.Millisecond,
+		ServerSelectionTimeout: time.Duration(fig.IntOr(0, key("timeout.server_selection"))) * time.Millisecond,
+	}
+}
+
+// Client options as per the config. Options left out
+// of the config are as given in the connection string
+func (cfg mongoConnConfig) clientOptions() (*options.ClientOptions, error) {
+	opts := options.Client().ApplyURI(cfg.ConnStr)
+
+	if cfg.AppName != "" {
+		opts.SetAppName(cfg.AppName)
+	}
+	if cfg.PoolMax > 0 {
+		opts.SetMaxPoolSize(uint64(cfg.PoolMax))
+	}
+	if cfg.PoolMin > 0 {
+		opts.SetMinPoolSize(uint64(cfg.PoolMin))
+	}
+
+	if cfg.AuthMechanism != "" || cfg.Username != "" {
+		cred := options.Credential{
+			AuthMechanism: cfg.AuthMechanism,
+			AuthSource:    cfg.AuthSource,
+			Username:      cfg.Username,
+			Password:      cfg.Password,
+			PasswordSet:   cfg.Password != "",
+		}
+		opts.SetAuth(cred)
+	}
+
+	if cfg.TLS {
+		tc := &tls.Config{InsecureSkipVerify: cfg.TLSInsecure}
+		if cfg.TLSCAFile != "" {
+			pem, err := ioutil.ReadFile(cfg.TLSCAFile)
+			if err != nil {
+				return nil, err
+			}
+			tc.RootCAs = x509.NewCertPool()
+			if !tc.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, errors.New("no certificates found in " + cfg.TLSCAFile)
+			}
+		}
+		if cfg.TLSCertFile != "" {
+			cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSCertFile)
+			if err != nil {
+				return nil, err
+			}
+			tc.Certificates = []tls.Certificate{cert}
+		}
+		opts.SetTLSConfig(tc)
+	}
+
+	if cfg.ConnectTimeout > 0 {
+		opts.SetConnectTimeout(cfg.ConnectTimeout)
+	}
+	if cfg.ServerSelectionTimeout > 0 {
+		opts.SetServerSelectionTimeout(cfg.ServerSelectionTimeout)
+	}
+
+	return opts, opts.Validate()
+}
+
+// MongoConnect to the connection configured under
+// database.mongo.<name> (not a reserved key)
+func NewMongoConnectNamed(name string) *MongoConnect {
+	if name == "" {
+		return NewMongoConnect()
+	}
+	if mongoReservedNames[name] {
+		panic("reserved connection name: " + name)
+	}
+	return &MongoConnect{
+		Name:    name,
+		ConnStr: fig.String(mongoConfigKey(name, "connection")),
+		DB:      fig.String(mongoConfigKey(name, "db")),
+		Cache:   mongoCache,
+	}
+}
+
+// MongoConnect to use for the model: this one, unless the
+// model picks another named connection. Tenancy suffixes
+// carry over. Work on models of another connection can't
+// be part of a transaction of this one
+func (mc *MongoConnect) forModel(model interface{}) *MongoConnect {
+	name := MongoConnectionName(model)
+	if name == "" || name == mc.Name {
+		return mc
+	}
+
+	mc.namedMu.RLock()
+	other, ok := mc.named[name]
+	mc.namedMu.RUnlock()
+	if ok {
+		return other
+	}
+
+	mc.namedMu.Lock()
+	defer mc.namedMu.Unlock()
+
+	if other, ok := mc.named[name]; ok {
+		return other
+	}
+	other = NewMongoConnectNamed(name)
+	other.DBSuffix = mc.DBSuffix
+	other.CollSuffix = mc.CollSuffix
+	other.Cache = mc.Cache
+
+	if mc.named == nil {
+		mc.named = map[string]*MongoConnect{}
+	}
+	mc.named[name] = other
+	return other
+}
+
+// Context for work on other, when it's another connection
+// than mc: the session (of mc) is left out, as it can only
+// be used on the connection it was started on
+func (mc *MongoConnect) contextFor(ctx context.Context, other *MongoConnect) context.Context {
+	if other == mc || mongo.SessionFromContext(ctx) == nil {
+		return ctx
+	}
+	return mongo.NewSessionContext(ctx, nil)
+}
+
+// Default timeout (in milliseconds) of an operation is read
+// from database.mongo[.connections.<name>].timeout.<op>, where op is one of
+// query / stream / transaction. Zero (the default) means no
+// timeout, other than the one ctx itself carries
+func (mc *MongoConnect) timeout(ctx context.Context, op string) (context.Context, context.CancelFunc) {
+	ms := fig.IntOr(0, mongoConfigKey("", "timeout."+op))
+	if mc.Name != "" {
+		ms = fig.IntOr(ms, mongoConfigKey(mc.Name, "timeout."+op))
+	}
+	if ms <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Duration(ms)*time.Millisecond)
+}
@@ -0,0 +1,98 @@
+package do
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type namedEvent struct{}
+
+func (namedEvent) MongoConnection() string {
+	return "analytics"
+}
+
+func TestMongoConnectionName(t *testing.T) {
+	assert.Equal(t, "analytics", MongoConnectionName(namedEvent{}))
+	assert.Equal(t, "analytics", MongoConnectionName(&namedEvent{}))
+	assert.Equal(t, "", MongoConnectionName(struct{}{}))
+	assert.Equal(t, "", MongoConnectionName("events"))
+
+	// Models of the connection itself stay on it
+	mc := &MongoConnect{Name: "analytics"}
+	assert.True(t, mc == mc.forModel(namedEvent{}))
+	mc = &MongoConnect{}
+	assert.True(t, mc == mc.forModel(struct{}{}))
+
+	// Others are resolved once (see NewMongoConnectNamed),
+	// and reused
+	analytics := &MongoConnect{Name: "analytics"}
+	mc.named = map[string]*MongoConnect{"analytics": analytics}
+	others := make([]*MongoConnect, 10)
+	wg := sync.WaitGroup{}
+	for i := range others {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			others[i] = mc.forModel(namedEvent{})
+		}(i)
+	}
+	wg.Wait()
+	for _, other := range others {
+		assert.True(t, other == analytics)
+	}
+
+	// Others can't be part of this one's transactions
+	sessCtx := mongo.NewSessionContext(context.Background(), &memorySession{})
+	assert.NotNil(t, mongo.SessionFromContext(mc.contextFor(sessCtx, mc)))
+	assert.Nil(t, mongo.SessionFromContext(mc.contextFor(sessCtx, analytics)))
+
+	policies := mongoRefPolicies{mc: mc, sessCtx: sessCtx}
+	_, err := policies.connFor(namedEvent{}, true)
+	assert.NotNil(t, err)
+	other, err := policies.connFor(namedEvent{}, false)
+	assert.Nil(t, err)
+	assert.True(t, other == analytics)
+}
+
+func TestMongoClientOptions(t *testing.T) {
+
+	assert.Equal(t, "database.mongo.db", mongoConfigKey("", "db"))
+	assert.Equal(t, "database.mongo.analytics.db", mongoConfigKey("analytics", "db"))
+
+	// Keys of the default connection can't name others
+	assert.Panics(t, func() { NewMongoConnectNamed("tenancy") })
+	assert.Panics(t, func() { NewMongoConnectNamed("timeout") })
+
+	opts, err := mongoConnConfig{
+		ConnStr:        "mongodb://localhost:27017",
+		AppName:        "billing",
+		PoolMax:        50,
+		AuthMechanism:  "SCRAM-SHA-256",
+		Username:       "app",
+		Password:       "secret",
+		ConnectTimeout: 5 * time.Second,
+		TLS:            true,
+	}.clientOptions()
+	assert.Nil(t, err)
+	assert.Equal(t, "billing", *opts.AppName)
+	assert.Equal(t, uint64(50), *opts.MaxPoolSize)
+	assert.Equal(t, "SCRAM-SHA-256", opts.Auth.AuthMechanism)
+	assert.True(t, opts.Auth.PasswordSet)
+	assert.Equal(t, 5*time.Second, *opts.ConnectTimeout)
+	assert.NotNil(t, opts.TLSConfig)
+
+	// Options left out come from the connection string
+	opts, err = mongoConnConfig{ConnStr: "mongodb://localhost:27017/?appName=legacy&maxPoolSize=7"}.clientOptions()
+	assert.Nil(t, err)
+	assert.Equal(t, "legacy", *opts.AppName)
+	assert.Equal(t, uint64(7), *opts.MaxPoolSize)
+	assert.Nil(t, opts.Auth)
+
+	_, err = mongoConnConfig{ConnStr: "mongodb://localhost", TLS: true, TLSCAFile: "/no/such/ca.pem"}.clientOptions()
+	assert.NotNil(t, err)
+}
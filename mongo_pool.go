@@ -0,0 +1,133 @@
+package do
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Process wide registry of mongo clients, keyed by
+// connection string. Every MongoConnect borrows its
+// client from here, so that connections (and their
+// handshakes) are reused across requests
+var mongoPool = struct {
+	sync.Mutex
+	entries map[string]*mongoPoolEntry
+}{
+	entries: map[string]*mongoPoolEntry{},
+}
+
+type mongoPoolEntry struct {
+	name      string
+	connStr   string
+	client    *mongo.Client
+	borrowers int64
+	open      int64
+	inUse     int64
+}
+
+type MongoPoolStat struct {
+	Name      string `json:"name"`
+	ConnStr   string `json:"-"`
+	Borrowers int64  `json:"borrowers"`
+	Open      int64  `json:"open"`
+	InUse     int64  `json:"in_use"`
+}
+
+// Clients are set up as per the config of the named
+// connection, so the name is part of the key
+func mongoPoolKey(name string, connStr string) string {
+	if name == "" {
+		return connStr
+	}
+	return name + "|" + connStr
+}
+
+func mongoPoolBorrow(name string, connStr string) (*mongo.Client, error) {
+	mongoPool.Lock()
+	defer mongoPool.Unlock()
+
+	key := mongoPoolKey(name, connStr)
+	if entry, ok := mongoPool.entries[key]; ok {
+		atomic.AddInt64(&entry.borrowers, 1)
+		return entry.client, nil
+	}
+
+	entry := &mongoPoolEntry{name: name, connStr: connStr}
+	monitor := &event.PoolMonitor{
+		Event: func(e *event.PoolEvent) {
+			switch e.Type {
+			case event.ConnectionCreated:
+				atomic.AddInt64(&entry.open, 1)
+			case event.ConnectionClosed:
+				atomic.AddInt64(&entry.open, -1)
+			case event.GetSucceeded:
+				atomic.AddInt64(&entry.inUse, 1)
+			case event.ConnectionReturned:
+				atomic.AddInt64(&entry.inUse, -1)
+			}
+		},
+	}
+
+	opts, err := mongoConfig(name, connStr).clientOptions()
+	if err != nil {
+		return nil, err
+	}
+	client, err := mongo.Connect(context.TODO(), opts.SetPoolMonitor(monitor))
+	if err != nil {
+		return nil, err
+	}
+
+	entry.client = client
+	entry.borrowers = 1
+	mongoPool.entries[key] = entry
+	return client, nil
+}
+
+func mongoPoolRelease(key string) {
+	mongoPool.Lock()
+	defer mongoPool.Unlock()
+
+	if entry, ok := mongoPool.entries[key]; ok {
+		atomic.AddInt64(&entry.borrowers, -1)
+	}
+}
+
+// Returns statistics of every client in the pool
+func MongoPoolStats() []MongoPoolStat {
+	mongoPool.Lock()
+	defer mongoPool.Unlock()
+
+	output := make([]MongoPoolStat, 0, len(mongoPool.entries))
+	for _, entry := range mongoPool.entries {
+		output = append(output, MongoPoolStat{
+			Name:      entry.name,
+			ConnStr:   entry.connStr,
+			Borrowers: atomic.LoadInt64(&entry.borrowers),
+			Open:      atomic.LoadInt64(&entry.open),
+			InUse:     atomic.LoadInt64(&entry.inUse),
+		})
+	}
+
+	return output
+}
+
+// Disconnects all clients in the pool. To be called
+// once, when the process shuts down
+func MongoPoolClose() {
+	mongoPool.Lock()
+	defer mongoPool.Unlock()
+
+	for key, entry := range mongoPool.entries {
+		if err := entry.client.Disconnect(context.TODO()); err != nil {
+			log.Error().
+				Err(err).
+				Msg("unable to close mongodb client connection")
+		}
+		delete(mongoPool.entries, key)
+	}
+}
@@ -0,0 +1,350 @@
+package do
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+	REFERENCES
+
+	type Order struct {
+		CustomerID string    `bson:"customer_id" json:"customer_id" ref:"customer"`
+		Customer   *Customer `bson:"-" json:"customer"`
+	}
+
+	A ref field holds the _id (or a slice of _ids) of documents
+	in the named collection. Inserts and updates check that the
+	referenced documents exist.
+
+	QueryOptions.Populate lists refs (by key of the ref field, or
+	of its sibling) whose documents are fetched, in one batched
+	$in query per ref, and decoded into the sibling field. The
+	sibling is the field keyed without the _id / _ids suffix.
+	Referenced documents are read through the connection of
+	their model (the sibling's type, or the model registered
+	for the collection, see MongoConnectionName).
+
+	What happens to a referring document, when the one it refers
+	to is deleted, is set with ref:"customer;delete=<policy>":
+
+		restrict  delete fails while there are referring documents (default)
+		cascade   referring documents are deleted as well
+		set_null  reference is unset (or pulled from a slice of ids)
+
+	Policies apply to models registered with RegisterModel. Soft
+	deletes leave references as they are (so that a restore finds
+	them intact): set_null does nothing, and cascade soft deletes
+	referring documents, or restricts when they can't be
+*/
+
+type refField struct {
+	index   int
+	key     string
+	coll    string
+	delete  string
+	many    bool
+	sibling int // -1 if there is none
+	sibKey  string
+	target  interface{} // model stored in coll (or its name)
+}
+
+// Ref fields of a model (top level only)
+func modelRefs(model interface{}) []refField {
+	if _, isName := model.(string); isName {
+		return nil
+	}
+	t := TypeDereference(TypeOf(model))
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+
+	wc := WalkConfig{"json"}
+	output := []refField{}
+	for i := 0; i < t.NumField(); i++ {
+		fld := t.Field(i)
+		parts := strings.Split(fld.Tag.Get("ref"), ";")
+		coll := strings.TrimSpace(parts[0])
+		if coll == "" {
+			continue
+		}
+
+		r := refField{
+			index:   i,
+			key:     wc.FieldKey(fld),
+			coll:    MongoCollectionName(coll),
+			delete:  "restrict",
+			many:    fld.Type.Kind() == reflect.Slice,
+			sibling: -1,
+		}
+		for _, part := range parts[1:] {
+			part = strings.TrimSpace(part)
+			if strings.HasPrefix(part, "delete=") {
+				r.delete = part[7:]
+			}
+		}
+
+		// customer_id gives customer, tag_ids gives tags
+		sibKey := strings.TrimSuffix(r.key, "_id")
+		if strings.HasSuffix(r.key, "_ids") {
+			sibKey = strings.TrimSuffix(r.key, "_ids") + "s"
+		}
+		for j := 0; j < t.NumField(); j++ {
+			if j != i && wc.FieldKey(t.Field(j)) == sibKey {
+				r.sibling = j
+				r.sibKey = sibKey
+			}
+		}
+
+		// Referenced model, to read it through its own
+		// connection: the sibling's type, else the one
+		// registered for coll
+		r.target = r.coll
+		if m, ok := allModels[r.coll]; ok {
+			r.target = m
+		}
+		if r.sibling >= 0 {
+			st := t.Field(r.sibling).Type
+			for st.Kind() == reflect.Ptr || st.Kind() == reflect.Slice {
+				st = st.Elem()
+			}
+			if st.Kind() == reflect.Struct {
+				r.target = reflect.New(st).Interface()
+			}
+		}
+
+		output = append(output, r)
+	}
+	return output
+}
+
+// Indexes of the fields refs get populated into. They
+// are not stored, so never part of the inputs
+func refSiblings(model interface{}) map[int]bool {
+	output := map[int]bool{}
+	t := TypeDereference(TypeOf(model))
+	for _, r := range modelRefs(model) {
+		if r.sibling >= 0 && t.Field(r.sibling).Tag.Get("bson") == "-" {
+			output[r.sibling] = true
+		}
+	}
+	return output
+}
+
+// Values of a ref (single or many), leaving out empty ones
+func refValues(v interface{}) []interface{} {
+	output := []interface{}{}
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() {
+		return output
+	}
+	if rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array {
+		for i := 0; i < rv.Len(); i++ {
+			output = append(output, refValues(rv.Index(i).Interface())...)
+		}
+		return output
+	}
+	if !rv.IsZero() {
+		output = append(output, v)
+	}
+	return output
+}
+
+// Numbers are compared by value, whatever their type
+func refKey(id interface{}) string {
+	switch n := id.(type) {
+	case int, int32, int64, float32, float64:
+		return fmt.Sprintf("number|%v", memoryNormalize(n))
+	}
+	return fmt.Sprintf("%T|%v", id, id)
+}
+
+// Fetches documents of a collection (where target, the
+// referenced model, is stored) by ids, keyed by refKey
+type refFetcher func(target interface{}, coll string, ids []interface{}, projection bson.M) (map[string]bson.Raw, error)
+
+func (mc *MongoConnect) refFetcher(ctx context.Context) refFetcher {
+	return func(target interface{}, coll string, ids []interface{}, projection bson.M) (map[string]bson.Raw, error) {
+		return mc.refsFound(ctx, target, coll, ids, projection)
+	}
+}
+
+func (mc *MongoConnect) refsFound(ctx context.Context, target interface{}, coll string, ids []interface{}, projection bson.M) (map[string]bson.Raw, error) {
+	found := map[string]bson.Raw{}
+	if len(ids) == 0 {
+		return found, nil
+	}
+
+	other := mc.forModel(target)
+	ctx = mc.contextFor(ctx, other)
+	mc = other
+
+	find := options.Find()
+	if projection != nil {
+		find.SetProjection(projection)
+	}
+	cursor, err := mc.Collection(coll).Find(ctx, bson.M{"_id": bson.M{"$in": ids}}, find)
+	if err != nil {
+		return nil, err
+	}
+	raws := []bson.Raw{}
+	if err = cursor.All(ctx, &raws); err != nil {
+		return nil, err
+	}
+
+	for _, raw := range raws {
+		var id interface{}
+		if err = raw.Lookup("_id").Unmarshal(&id); err != nil {
+			return nil, err
+		}
+		found[refKey(id)] = raw
+	}
+	return found, nil
+}
+
+// Checks that the documents referenced by each of the rows
+// (inputs of insert / update) exist. Errors are per row
+func refErrors(fetch refFetcher, model interface{}, rows ...Map) ([][]ErrorPlus, error) {
+	output := make([][]ErrorPlus, len(rows))
+
+	for _, r := range modelRefs(model) {
+		ids := []interface{}{}
+		for _, row := range rows {
+			if val, ok := row[r.key]; ok {
+				ids = append(ids, refValues(val)...)
+			}
+		}
+		found, err := fetch(r.target, r.coll, ids, bson.M{"_id": 1})
+		if err != nil {
+			return nil, err
+		}
+
+		for i, row := range rows {
+			for _, id := range refValues(row[r.key]) {
+				if _, ok := found[refKey(id)]; !ok {
+					output[i] = append(output[i], ErrorPlus{
+						Message: fmt.Sprintf("%v not found in %s", id, r.coll),
+						Source:  r.key,
+					})
+					break
+				}
+			}
+		}
+	}
+
+	return output, nil
+}
+
+// Fetches documents referenced by the items of the slice
+// (addrSlice points to) and sets them into sibling fields
+func populateRefs(fetch refFetcher, model interface{}, addrSlice interface{}, names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+
+	refs := modelRefs(model)
+	sv := reflect.ValueOf(addrSlice).Elem()
+
+	for _, name := range names {
+		var r *refField
+		for i := range refs {
+			if refs[i].key == name || (refs[i].sibling >= 0 && refs[i].sibKey == name) {
+				r = &refs[i]
+			}
+		}
+		if r == nil {
+			return fmt.Errorf("unknown reference: %s", name)
+		}
+		if r.sibling < 0 {
+			return fmt.Errorf("no field to populate %s into", name)
+		}
+
+		// Fetch all referenced documents at once
+		ids := []interface{}{}
+		seen := map[string]bool{}
+		for i := 0; i < sv.Len(); i++ {
+			item := reflect.Indirect(sv.Index(i))
+			for _, id := range refValues(item.Field(r.index).Interface()) {
+				if !seen[refKey(id)] {
+					seen[refKey(id)] = true
+					ids = append(ids, id)
+				}
+			}
+		}
+		// select:"never" fields of the referenced model
+		// are left out too
+		ft := TypeDereference(sv.Type().Elem()).Field(r.sibling).Type
+		for ft.Kind() == reflect.Ptr || ft.Kind() == reflect.Slice {
+			ft = ft.Elem()
+		}
+		found, err := fetch(r.target, r.coll, ids, queryProjection(reflect.New(ft).Interface(), nil))
+		if err != nil {
+			return err
+		}
+
+		for i := 0; i < sv.Len(); i++ {
+			item := reflect.Indirect(sv.Index(i))
+			err := populateField(item.Field(r.sibling), refValues(item.Field(r.index).Interface()), found)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Decodes documents of the ids into a field, which may be a
+// struct, pointer to one, or a slice of either
+func populateField(field reflect.Value, ids []interface{}, found map[string]bson.Raw) error {
+	decode := func(t reflect.Type, raw bson.Raw) (reflect.Value, error) {
+		ptr := t.Kind() == reflect.Ptr
+		if ptr {
+			t = t.Elem()
+		}
+		v := reflect.New(t)
+		err := bson.Unmarshal(raw, v.Interface())
+		if err == nil {
+			err = decryptFields(v.Interface())
+		}
+		if ptr {
+			return v, err
+		}
+		return v.Elem(), err
+	}
+
+	if field.Kind() == reflect.Slice {
+		out := reflect.MakeSlice(field.Type(), 0, len(ids))
+		for _, id := range ids {
+			if raw, ok := found[refKey(id)]; ok {
+				v, err := decode(field.Type().Elem(), raw)
+				if err != nil {
+					return err
+				}
+				out = reflect.Append(out, v)
+			}
+		}
+		field.Set(out)
+		return nil
+	}
+
+	field.Set(reflect.Zero(field.Type()))
+	if len(ids) == 0 {
+		return nil
+	}
+	raw, ok := found[refKey(ids[0])]
+	if !ok {
+		return nil
+	}
+	v, err := decode(field.Type(), raw)
+	if err != nil {
+		return err
+	}
+	field.Set(v)
+	return nil
+}
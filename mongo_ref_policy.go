@@ -0,0 +1,243 @@
+package do
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Models whose references get delete policies applied,
+// keyed by collection name
+var allModels = map[string]interface{}{}
+
+func RegisterModel(models ...interface{}) {
+	for _, m := range models {
+		coll := MongoCollectionName(m)
+		for _, r := range modelRefs(m) {
+			switch r.delete {
+			case "restrict", "cascade", "set_null":
+			default:
+				panic(fmt.Sprintf("invalid delete policy of %s.%s: %s", coll, r.key, r.delete))
+			}
+		}
+		allModels[coll] = m
+	}
+}
+
+type referrer struct {
+	model interface{}
+	ref   refField
+}
+
+// Registered models (and their refs) referring to a collection
+func referrersOf(coll string) []referrer {
+	names := make([]string, 0, len(allModels))
+	for name := range allModels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	output := []referrer{}
+	for _, name := range names {
+		for _, r := range modelRefs(allModels[name]) {
+			if r.coll == coll {
+				output = append(output, referrer{model: allModels[name], ref: r})
+			}
+		}
+	}
+	return output
+}
+
+// What delete policies need of a store. Referring documents
+// are those of the model that are not soft deleted
+type refPolicyStore interface {
+	countRefs(model interface{}, filter bson.M) (int64, error)
+	refIDs(model interface{}, filter bson.M) ([]interface{}, error)
+
+	// Deletes a referring document, applying its own policies,
+	// hooks and audit trail
+	deleteRef(model interface{}, id interface{}, deletedBy string) []ErrorPlus
+
+	// Unsets the reference (or pulls id from a slice of them)
+	unsetRefs(rf referrer, id interface{}) error
+}
+
+// Policy applied to a referrer. Soft deletes leave references
+// as they are (so that a restore finds them intact), so they
+// can only cascade to referrers that are soft deleted as well:
+// others restrict the delete
+func deletePolicy(rf referrer, soft bool) string {
+	if !soft {
+		return rf.ref.delete
+	}
+	switch rf.ref.delete {
+	case "set_null":
+		return ""
+	case "cascade":
+		if !isSoftDeletable(rf.model) {
+			return "restrict"
+		}
+	}
+	return rf.ref.delete
+}
+
+// Applies delete policies of documents referring to the one
+// (with given id) being deleted. Blocking references come
+// back as errors, with the referring collection as source
+func applyDeletePolicies(store refPolicyStore, model interface{}, id interface{}, soft bool, deletedBy string) ([]ErrorPlus, error) {
+
+	referrers := referrersOf(MongoCollectionName(model))
+
+	// Restrict
+	blocking := []ErrorPlus{}
+	for _, rf := range referrers {
+		if deletePolicy(rf, soft) != "restrict" {
+			continue
+		}
+		count, err := store.countRefs(rf.model, bson.M{rf.ref.key: id})
+		if err != nil {
+			return nil, err
+		}
+		if count > 0 {
+			blocking = append(blocking, ErrorPlus{
+				Message: fmt.Sprintf("referred to by %d document(s) through %s", count, rf.ref.key),
+				Source:  MongoCollectionName(rf.model),
+			})
+		}
+	}
+	if len(blocking) > 0 {
+		return blocking, nil
+	}
+
+	for _, rf := range referrers {
+		switch deletePolicy(rf, soft) {
+		case "cascade":
+			// Deleted one by one, so that their own
+			// policies, hooks and audit trail apply
+			children, err := store.refIDs(rf.model, bson.M{rf.ref.key: id})
+			if err != nil {
+				return nil, err
+			}
+			for _, child := range children {
+				errs := store.deleteRef(rf.model, child, deletedBy)
+				if len(errs) > 0 {
+					for i := range errs {
+						if errs[i].Source == "" {
+							errs[i].Source = MongoCollectionName(rf.model)
+						}
+					}
+					return errs, nil
+				}
+			}
+
+		case "set_null":
+			if err := store.unsetRefs(rf, id); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+// Delete policies, run in the transaction of the delete
+type mongoRefPolicies struct {
+	mc      *MongoConnect
+	ctx     context.Context
+	sessCtx mongo.SessionContext
+}
+
+// Referring documents on another connection can be counted
+// (outside the transaction), but not changed
+func (p mongoRefPolicies) connFor(model interface{}, write bool) (*MongoConnect, error) {
+	other := p.mc.forModel(model)
+	if write && other != p.mc {
+		return nil, fmt.Errorf("delete policies of %s can't apply across connections", MongoCollectionName(model))
+	}
+	return other, nil
+}
+
+func (p mongoRefPolicies) countRefs(model interface{}, filter bson.M) (int64, error) {
+	mc, _ := p.connFor(model, false)
+	return mc.Collection(model).CountDocuments(p.mc.contextFor(p.sessCtx, mc), excludeSoftDeleted(model, filter))
+}
+
+func (p mongoRefPolicies) refIDs(model interface{}, filter bson.M) ([]interface{}, error) {
+	if _, err := p.connFor(model, true); err != nil {
+		return nil, err
+	}
+	cursor, err := p.mc.Collection(model).Find(p.sessCtx, excludeSoftDeleted(model, filter), options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	raws := []bson.Raw{}
+	if err = cursor.All(p.sessCtx, &raws); err != nil {
+		return nil, err
+	}
+
+	ids := []interface{}{}
+	for _, raw := range raws {
+		ids = append(ids, raw.Lookup("_id"))
+	}
+	return ids, nil
+}
+
+func (p mongoRefPolicies) deleteRef(model interface{}, id interface{}, deletedBy string) []ErrorPlus {
+	if _, err := p.connFor(model, true); err != nil {
+		return []ErrorPlus{{Message: err.Error()}}
+	}
+	object := reflect.New(TypeDereference(TypeOf(model))).Interface()
+	return p.mc.DeleteFormByCtx(p.ctx, object, bson.M{"_id": id}, deletedBy, p.sessCtx)
+}
+
+func (p mongoRefPolicies) unsetRefs(rf referrer, id interface{}) error {
+	if _, err := p.connFor(rf.model, true); err != nil {
+		return err
+	}
+	update := bson.M{"$set": bson.M{rf.ref.key: nil}}
+	if rf.ref.many {
+		update = bson.M{"$pull": bson.M{rf.ref.key: id}}
+	}
+	if isVersioned(rf.model) {
+		update["$inc"] = bson.M{"version": 1}
+	}
+	filter := bson.M{rf.ref.key: id}
+
+	// Audit trail needs the documents as they were
+	audited := isAudited(rf.model)
+	var before map[string]bson.M
+	if audited {
+		snaps, err := p.mc.auditSnapshots(p.sessCtx, rf.model, filter)
+		if err != nil {
+			return err
+		}
+		before = snaps
+	}
+
+	if _, err := p.mc.Collection(rf.model).UpdateMany(p.sessCtx, filter, update); err != nil {
+		return err
+	}
+	p.mc.cacheInvalidate(rf.model, p.sessCtx)
+
+	if audited && len(before) > 0 {
+		ids := bson.A{}
+		for _, doc := range before {
+			ids = append(ids, doc["_id"])
+		}
+		after, err := p.mc.auditSnapshots(p.sessCtx, rf.model, bson.M{"_id": bson.M{"$in": ids}})
+		if err != nil {
+			return err
+		}
+		for key, doc := range before {
+			if err = p.mc.audit(p.sessCtx, rf.model, "update", doc, after[key]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
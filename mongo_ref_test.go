@@ -0,0 +1,282 @@
+package do
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type refCustomer struct {
+	MongoEntity
+	ID     string `bson:"_id" json:"id" insert:"no" auto:"prefix:c-;alphanum(6)"`
+	Name   string `bson:"name" json:"name" insert:"yes"`
+	Secret string `bson:"secret" json:"secret" select:"never"`
+}
+
+type refOrder struct {
+	MongoEntity
+	ID         string        `bson:"_id" json:"id" insert:"no" auto:"prefix:o-;alphanum(6)"`
+	CustomerID string        `bson:"customer_id" json:"customer_id" ref:"ref_customer"`
+	Customer   *refCustomer  `bson:"-" json:"customer"`
+	WatcherIDs []string      `bson:"watcher_ids" json:"watcher_ids" ref:"ref_customer"`
+	Watchers   []refCustomer `bson:"-" json:"watchers"`
+}
+
+func TestModelRefs(t *testing.T) {
+
+	refs := modelRefs(refOrder{})
+	assert.Equal(t, 2, len(refs))
+	assert.Equal(t, "customer_id", refs[0].key)
+	assert.Equal(t, "ref_customer", refs[0].coll)
+	assert.Equal(t, "customer", refs[0].sibKey)
+	assert.Equal(t, "watchers", refs[1].sibKey)
+
+	// Referenced models, to pick their connection
+	assert.IsType(t, &refCustomer{}, refs[0].target)
+	refs = modelRefs(struct {
+		EventID string `json:"event_id" ref:"named_event"`
+	}{})
+	assert.Equal(t, "named_event", refs[0].target)
+	RegisterModel(namedEvent{})
+	defer func() { allModels = map[string]interface{}{} }()
+	refs = modelRefs(struct {
+		EventID string `json:"event_id" ref:"named_event"`
+	}{})
+	assert.Equal(t, "analytics", MongoConnectionName(refs[0].target))
+
+	// Only fields refs get populated into are left out
+	// of walks, other bson:"-" ones are walked
+	walked := []string{}
+	StructWalk(struct {
+		CustomerID string       `bson:"customer_id" json:"customer_id" ref:"ref_customer"`
+		Customer   *refCustomer `bson:"-" json:"customer"`
+		Note       string       `bson:"-" json:"note"`
+	}{}, WalkConfig{"json"}, Map{}, func(fld reflect.StructField, data Map, keys ...string) []ErrorPlus {
+		walked = append(walked, strings.Join(keys, "."))
+		return nil
+	})
+	assert.Contains(t, walked, "note")
+	assert.Contains(t, walked, "customer_id")
+	assert.NotContains(t, walked, "customer.name")
+
+	assert.Nil(t, modelRefs("ref_order"))
+	assert.Equal(t, refKey(int32(5)), refKey(5.0))
+	assert.Equal(t, []interface{}{"a", "b"}, refValues([]string{"a", "", "b"}))
+}
+
+func TestRefs(t *testing.T) {
+
+	ms := NewMemoryStore()
+
+	c1, c2 := refCustomer{}, refCustomer{}
+	assert.Equal(t, 0, len(ms.InsertForm(&c1, Map{"name": "abc", "secret": "x"})))
+	assert.Equal(t, 0, len(ms.InsertForm(&c2, Map{"name": "def"})))
+
+	// Referenced documents must exist
+	errs := ms.InsertForm(&refOrder{}, Map{"customer_id": "c-nope"})
+	assert.Equal(t, 1, len(errs))
+	assert.Equal(t, "customer_id", errs[0].Source)
+
+	o := refOrder{}
+	errs = ms.InsertForm(&o, Map{"customer_id": c1.ID, "watcher_ids": []string{c2.ID, c1.ID}})
+	assert.Equal(t, 0, len(errs))
+
+	errs = ms.UpdateForm(&refOrder{}, bson.M{"_id": o.ID}, Map{"watcher_ids": []string{c2.ID, "c-nope"}})
+	assert.Equal(t, 1, len(errs))
+	assert.Equal(t, "watcher_ids", errs[0].Source)
+
+	// Populate, by key of the ref or of its sibling
+	rows := []refOrder{}
+	_, err := ms.Query(refOrder{}, &rows, QueryOptions{Populate: []string{"customer_id", "watchers"}})
+	assert.Nil(t, err)
+	assert.Equal(t, "abc", rows[0].Customer.Name)
+	assert.Equal(t, "", rows[0].Customer.Secret)
+	assert.Equal(t, 2, len(rows[0].Watchers))
+	assert.Equal(t, "def", rows[0].Watchers[0].Name)
+
+	_, err = ms.Query(refOrder{}, &rows, QueryOptions{Populate: []string{"nope"}})
+	assert.NotNil(t, err)
+}
+
+type refInvoice struct {
+	ID         string   `bson:"_id" json:"id"`
+	CustomerID string   `bson:"customer_id" json:"customer_id" ref:"ref_customer;delete=cascade"`
+	PayerIDs   []string `bson:"payer_ids" json:"payer_ids" ref:"ref_customer;delete=set_null"`
+}
+
+func TestDeletePolicies(t *testing.T) {
+
+	defer func() { allModels = map[string]interface{}{} }()
+
+	RegisterModel(refOrder{}, refInvoice{})
+	referrers := referrersOf("ref_customer")
+	assert.Equal(t, 4, len(referrers))
+	assert.Equal(t, "cascade", referrers[0].ref.delete)
+	assert.Equal(t, "set_null", referrers[1].ref.delete)
+	assert.True(t, referrers[1].ref.many)
+	assert.Equal(t, "restrict", referrers[2].ref.delete)
+	assert.Equal(t, 0, len(referrersOf("ref_order")))
+
+	assert.Panics(t, func() {
+		RegisterModel(struct {
+			CustomerID string `ref:"ref_customer;delete=nope"`
+		}{})
+	})
+}
+
+type polOwner struct {
+	MongoEntity
+	ID string `bson:"_id" json:"id" insert:"no" auto:"prefix:o-;alphanum(6)"`
+}
+
+// Same collection, but soft deleted
+type polSoftOwner struct {
+	MongoEntity
+	ID          string `bson:"_id" json:"id" insert:"no" auto:"prefix:o-;alphanum(6)"`
+	SoftDeleted `bson:"inline"`
+}
+
+func (polSoftOwner) CollectionName() string {
+	return "pol_owner"
+}
+
+type polPin struct {
+	MongoEntity
+	ID      string `bson:"_id" json:"id" insert:"no" auto:"prefix:p-;alphanum(6)"`
+	OwnerID string `bson:"owner_id" json:"owner_id" ref:"pol_owner"`
+}
+
+type polDoc struct {
+	MongoEntity
+	ID          string `bson:"_id" json:"id" insert:"no" auto:"prefix:d-;alphanum(6)"`
+	OwnerID     string `bson:"owner_id" json:"owner_id" ref:"pol_owner;delete=cascade"`
+	SoftDeleted `bson:"inline"`
+}
+
+type polLog struct {
+	MongoEntity
+	ID      string `bson:"_id" json:"id" insert:"no" auto:"prefix:l-;alphanum(6)"`
+	OwnerID string `bson:"owner_id" json:"owner_id" ref:"pol_owner;delete=cascade"`
+}
+
+type polTag struct {
+	MongoEntity
+	ID       string   `bson:"_id" json:"id" insert:"no" auto:"prefix:t-;alphanum(6)"`
+	OwnerID  string   `bson:"owner_id" json:"owner_id" ref:"pol_owner;delete=set_null"`
+	OwnerIDs []string `bson:"owner_ids" json:"owner_ids" ref:"pol_owner;delete=set_null"`
+}
+
+func TestApplyDeletePolicies(t *testing.T) {
+
+	defer func() { allModels = map[string]interface{}{} }()
+
+	// Store with given models registered, and two owners
+	setup := func(soft bool, models ...interface{}) (*MemoryStore, string, string) {
+		allModels = map[string]interface{}{}
+		RegisterModel(models...)
+
+		ms := NewMemoryStore()
+		ids := []string{}
+		for i := 0; i < 2; i++ {
+			if soft {
+				o := polSoftOwner{}
+				assert.Equal(t, 0, len(ms.InsertForm(&o, Map{})))
+				ids = append(ids, o.ID)
+			} else {
+				o := polOwner{}
+				assert.Equal(t, 0, len(ms.InsertForm(&o, Map{})))
+				ids = append(ids, o.ID)
+			}
+		}
+		return ms, ids[0], ids[1]
+	}
+	deleteOwner := func(ms *MemoryStore, soft bool, id string) []ErrorPlus {
+		if soft {
+			return ms.DeleteForm(&polSoftOwner{}, bson.M{"_id": id})
+		}
+		return ms.DeleteForm(&polOwner{}, bson.M{"_id": id})
+	}
+
+	// Restrict
+	for _, soft := range []bool{false, true} {
+		ms, o1, _ := setup(soft, polPin{})
+		pin := polPin{}
+		ms.InsertForm(&pin, Map{"owner_id": o1})
+
+		errs := deleteOwner(ms, soft, o1)
+		assert.Equal(t, 1, len(errs))
+		assert.Equal(t, "pol_pin", errs[0].Source)
+		assert.Nil(t, ms.data["pol_owner"][0]["deleted_at"])
+		assert.Equal(t, 2, len(ms.data["pol_owner"]))
+
+		ms.DeleteForm(&polPin{}, bson.M{"_id": pin.ID})
+		assert.Equal(t, 0, len(deleteOwner(ms, soft, o1)))
+	}
+
+	// Cascade, on a hard delete: referring documents are
+	// deleted (soft deletable ones, softly)
+	{
+		ms, o1, o2 := setup(false, polDoc{}, polLog{})
+		ms.InsertForm(&polDoc{}, Map{"owner_id": o1})
+		ms.InsertForm(&polLog{}, Map{"owner_id": o1})
+		ms.InsertForm(&polLog{}, Map{"owner_id": o2})
+
+		assert.Equal(t, 0, len(deleteOwner(ms, false, o1)))
+		assert.Equal(t, 1, len(ms.data["pol_owner"]))
+		assert.NotNil(t, ms.data["pol_doc"][0]["deleted_at"])
+		assert.Equal(t, 1, len(ms.data["pol_log"]))
+		assert.Equal(t, o2, ms.data["pol_log"][0]["owner_id"])
+	}
+
+	// Cascade, on a soft delete: only to soft deletable
+	// documents, others restrict the delete
+	{
+		ms, o1, _ := setup(true, polDoc{})
+		ms.InsertForm(&polDoc{}, Map{"owner_id": o1})
+		assert.Equal(t, 0, len(deleteOwner(ms, true, o1)))
+		assert.NotNil(t, ms.data["pol_owner"][0]["deleted_at"])
+		assert.NotNil(t, ms.data["pol_doc"][0]["deleted_at"])
+
+		ms, o1, _ = setup(true, polDoc{}, polLog{})
+		ms.InsertForm(&polDoc{}, Map{"owner_id": o1})
+		ms.InsertForm(&polLog{}, Map{"owner_id": o1})
+		errs := deleteOwner(ms, true, o1)
+		assert.Equal(t, 1, len(errs))
+		assert.Equal(t, "pol_log", errs[0].Source)
+		assert.Nil(t, ms.data["pol_owner"][0]["deleted_at"])
+		assert.Nil(t, ms.data["pol_doc"][0]["deleted_at"])
+		assert.Equal(t, 1, len(ms.data["pol_log"]))
+	}
+
+	// Set null, on a hard delete only
+	for _, soft := range []bool{false, true} {
+		ms, o1, o2 := setup(soft, polTag{})
+		ms.InsertForm(&polTag{}, Map{"owner_id": o1, "owner_ids": []string{o1, o2}})
+
+		assert.Equal(t, 0, len(deleteOwner(ms, soft, o1)))
+		tag := ms.data["pol_tag"][0]
+		if soft {
+			assert.Equal(t, o1, tag["owner_id"])
+			assert.Equal(t, 2, len(memoryList(tag["owner_ids"])))
+		} else {
+			assert.Nil(t, tag["owner_id"])
+			assert.Equal(t, []interface{}{o2}, memoryList(tag["owner_ids"]))
+		}
+	}
+}
+
+func TestPopulateItem(t *testing.T) {
+
+	ms := NewMemoryStore()
+	c := refCustomer{}
+	ms.InsertForm(&c, Map{"name": "abc"})
+
+	o := &refOrder{CustomerID: c.ID}
+	assert.Nil(t, populateItem(ms.refsFound, refOrder{}, o, []string{"customer"}))
+	assert.Equal(t, "abc", o.Customer.Name)
+
+	assert.NotNil(t, populateItem(ms.refsFound, refOrder{}, o, []string{"nope"}))
+}
@@ -0,0 +1,108 @@
+package do
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/rightjoin/fig"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func (mc *MongoConnect) QueryEach(model interface{}, opt QueryOptions, each func(item interface{}) error) error {
+	return mc.QueryEachCtx(context.Background(), model, opt, each)
+}
+
+// Streams the documents matched by opt, decoding them one at
+// a time into a new instance of model (a pointer to which is
+// passed to each). Streaming stops at the first error returned
+// by each, and that error is returned. Refs in opt.Populate
+// are populated for each document (one query per ref)
+func (mc *MongoConnect) QueryEachCtx(ctx context.Context, model interface{}, opt QueryOptions, each func(item interface{}) error) error {
+
+	if opt.After != "" || opt.Before != "" {
+		return errKeysetCursor
+	}
+
+	mc = mc.forModel(model)
+
+	ctx, cancel := mc.timeout(ctx, "stream")
+	defer cancel()
+
+	if opt.Query == nil {
+		opt.Query = bson.D{}
+	}
+
+	// Leave out soft deleted documents, unless asked for
+	if !opt.WithDeleted {
+		opt.Query = excludeSoftDeleted(model, opt.Query)
+	}
+
+	find := &options.FindOptions{
+		Skip:       P_int64(int64(opt.Skip)),
+		Limit:      P_int64(int64(opt.Limit)),
+		Sort:       opt.Sort,
+		Collation:  queryCollation(model, opt),
+		Projection: queryProjection(model, opt.Projection),
+	}
+	if opt.Paginate {
+		if opt.Page <= 0 {
+			opt.Page = 1
+		}
+		max := fig.IntOr(25, "pagination.chunk")
+		if opt.Chunk < 1 || opt.Chunk > max {
+			opt.Chunk = max
+		}
+		find.Skip = P_int64(int64((opt.Page - 1) * opt.Chunk))
+		find.Limit = P_int64(int64(opt.Chunk))
+	}
+	if opt.BatchSize > 0 {
+		find.BatchSize = P_int32(int32(opt.BatchSize))
+	}
+
+	coll, err := mc.queryCollection(model, opt)
+	if err != nil {
+		return err
+	}
+	cursor, err := coll.Find(ctx, opt.Query, find)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.Background())
+
+	// Type to decode each document into
+	var itemType reflect.Type
+	if _, isName := model.(string); isName {
+		itemType = reflect.TypeOf(bson.M{})
+	} else {
+		itemType = TypeDereference(TypeOf(model))
+	}
+
+	for cursor.Next(ctx) {
+		item := reflect.New(itemType).Interface()
+		if err = cursor.Decode(item); err != nil {
+			return err
+		}
+		if err = decryptFields(item); err != nil {
+			return err
+		}
+		if err = populateItem(mc.refFetcher(ctx), model, item, opt.Populate); err != nil {
+			return err
+		}
+		if err = each(item); err != nil {
+			return err
+		}
+	}
+
+	return cursor.Err()
+}
+
+// Populates refs of a single item (a pointer to a model)
+func populateItem(fetch refFetcher, model interface{}, item interface{}, names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	slice := reflect.New(reflect.SliceOf(reflect.TypeOf(item)))
+	slice.Elem().Set(reflect.Append(slice.Elem(), reflect.ValueOf(item)))
+	return populateRefs(fetch, model, slice.Interface(), names)
+}
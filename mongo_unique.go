@@ -0,0 +1,184 @@
+package do
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+	UNIQUE FIELDS
+
+	Unique indexes (see index tag) are what keep values unique.
+	Their violations (E11000) are reported against the fields
+	of the index, e.g. {Source: "email", Message: "already taken"}
+
+	unique:"true" additionally checks the value before writing,
+	so that it is reported along with other validation errors
+	of the form
+*/
+
+const msgTaken = "already taken"
+
+var dupKeyRex = regexp.MustCompile(`index: (\S+) dup key: \{(.*)\}`)
+var dupKeyFieldRex = regexp.MustCompile(`([\w.$]+)\s*:`)
+
+// Errors of a write, with duplicate key errors reported
+// against the fields of the violated index
+func writeErrorPlus(model interface{}, err error) []ErrorPlus {
+	if dup := duplicateKeyErrors(model, err); len(dup) > 0 {
+		return dup
+	}
+	return []ErrorPlus{{Message: err.Error()}}
+}
+
+func duplicateKeyErrors(model interface{}, err error) []ErrorPlus {
+	if !mongo.IsDuplicateKeyError(err) {
+		return nil
+	}
+
+	// Message of the (first) duplicate key error
+	msg := err.Error()
+	var we mongo.WriteException
+	if errors.As(err, &we) {
+		for _, e := range we.WriteErrors {
+			if e.Code == 11000 || e.Code == 11001 || e.Code == 12582 {
+				msg = e.Message
+				break
+			}
+		}
+	}
+
+	return duplicateKeyErrorPlus(model, msg)
+}
+
+// One error per field of the index an E11000 message names
+func duplicateKeyErrorPlus(model interface{}, msg string) []ErrorPlus {
+	output := []ErrorPlus{}
+	for _, f := range duplicateKeyFields(model, msg) {
+		output = append(output, ErrorPlus{Message: msgTaken, Source: jsonKeyOfBson(model, f)})
+	}
+	if len(output) == 0 {
+		output = append(output, ErrorPlus{Message: msgTaken})
+	}
+	return output
+}
+
+// Fields of the index named in an E11000 message, from
+// the indexes the model declares, or else the message
+func duplicateKeyFields(model interface{}, msg string) []string {
+	match := dupKeyRex.FindStringSubmatch(msg)
+	if match == nil {
+		return nil
+	}
+
+	fields := []string{}
+	if _, isName := model.(string); !isName {
+		if indexes, err := ModelIndexes(model); err == nil {
+			for _, idx := range indexes {
+				if idx.Name == match[1] {
+					for _, k := range idx.Keys {
+						fields = append(fields, k.Key)
+					}
+					return fields
+				}
+			}
+		}
+	}
+
+	// Keys are listed from server 4.2 on, e.g. { email: "a@b.com" }
+	for _, m := range dupKeyFieldRex.FindAllStringSubmatch(match[2], -1) {
+		fields = append(fields, m[1])
+	}
+	if len(fields) == 0 && match[1] == "_id_" {
+		fields = append(fields, "_id")
+	}
+	return fields
+}
+
+// Json key of a (top level) field given its bson key
+func jsonKeyOfBson(model interface{}, key string) string {
+	if _, isName := model.(string); isName {
+		return key
+	}
+	t := TypeDereference(TypeOf(model))
+	if t.Kind() != reflect.Struct {
+		return key
+	}
+
+	wc := WalkConfig{"json"}
+	for i := 0; i < t.NumField(); i++ {
+		fld := t.Field(i)
+		if k, _ := bsonFieldKey(fld); k == key {
+			return wc.FieldKey(fld)
+		}
+	}
+	return key
+}
+
+func (mc *MongoConnect) uniqueCounter(ctx context.Context, model interface{}) func(filter interface{}) (int64, error) {
+	return func(filter interface{}) (int64, error) {
+		return mc.Collection(model).CountDocuments(ctx, filter, options.Count().SetCollation(queryCollation(model, QueryOptions{})))
+	}
+}
+
+// Checks values of unique:"true" fields against documents
+// in DB (other than the ones matching exclude, when updating)
+func uniqueErrors(model interface{}, data Map, exclude interface{}, count func(filter interface{}) (int64, error)) ([]ErrorPlus, error) {
+
+	type uniqueValue struct {
+		path  string
+		key   string // stored at
+		value interface{}
+	}
+	values := []uniqueValue{}
+	errs := []ErrorPlus{}
+	collect := func(fld reflect.StructField, data Map, keys ...string) []ErrorPlus {
+		fname := keys[len(keys)-1]
+		tag := fld.Tag.Get("unique")
+		if (tag != "true" && tag != "yes") || !data.HasKey(fname) {
+			return nil
+		}
+		v := data[fname]
+		if v == nil || v == "" {
+			return nil
+		}
+		path := strings.Join(keys, ".")
+
+		// Encrypted values are compared by their blind index
+		if et, encrypted := parseEncryptTag(fld, fname); encrypted {
+			if et.blind == "" {
+				errs = append(errs, ErrorPlus{Message: "unique encrypted fields need a blind index", Source: path})
+			} else if data[et.blind] != nil {
+				blind := append(append([]string{}, keys[:len(keys)-1]...), et.blind)
+				values = append(values, uniqueValue{path: path, key: strings.Join(blind, "."), value: data[et.blind]})
+			}
+			return nil
+		}
+
+		values = append(values, uniqueValue{path: path, key: path, value: v})
+		return nil
+	}
+	StructWalk(model, WalkConfig{"json"}, data, collect)
+
+	for _, uv := range values {
+		var filter interface{} = bson.M{uv.key: uv.value}
+		if exclude != nil {
+			filter = bson.M{"$and": bson.A{filter, bson.M{"$nor": bson.A{exclude}}}}
+		}
+		n, err := count(filter)
+		if err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			errs = append(errs, ErrorPlus{Message: msgTaken, Source: uv.path})
+		}
+	}
+	return errs, nil
+}
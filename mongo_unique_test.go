@@ -0,0 +1,60 @@
+package do
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type uniqUser struct {
+	MongoEntity
+	ID     string `bson:"_id" json:"id" insert:"no" auto:"prefix:u-;alphanum(6)"`
+	Email  string `bson:"email" json:"email" index:"unique" unique:"true"`
+	Org    string `bson:"org_id" json:"org" index:"unique;name=org_handle"`
+	Handle string `bson:"handle" json:"handle" index:"unique;name=org_handle"`
+}
+
+func TestDuplicateKeyErrors(t *testing.T) {
+
+	dup := func(msg string) error {
+		return mongo.WriteException{WriteErrors: []mongo.WriteError{{Code: 11000, Message: msg}}}
+	}
+
+	// Fields of the index declared by the model, as json keys
+	errs := writeErrorPlus(uniqUser{}, dup(`E11000 duplicate key error collection: db.uniq_user index: org_handle dup key: { org_id: "a", handle: "b" }`))
+	assert.Equal(t, []ErrorPlus{{Message: "already taken", Source: "org"}, {Message: "already taken", Source: "handle"}}, errs)
+
+	// Else fields listed in the message
+	errs = writeErrorPlus("uniq_user", dup(`E11000 duplicate key error collection: db.uniq_user index: nick_1 dup key: { nick: "x" }`))
+	assert.Equal(t, []ErrorPlus{{Message: "already taken", Source: "nick"}}, errs)
+
+	errs = writeErrorPlus(uniqUser{}, dup(`E11000 duplicate key error collection: db.uniq_user index: _id_ dup key: { : "x" }`))
+	assert.Equal(t, []ErrorPlus{{Message: "already taken", Source: "id"}}, errs)
+
+	// Other errors pass through
+	errs = writeErrorPlus(uniqUser{}, errors.New("boom"))
+	assert.Equal(t, []ErrorPlus{{Message: "boom"}}, errs)
+}
+
+func TestUniquePrecheck(t *testing.T) {
+
+	ms := NewMemoryStore()
+
+	u := uniqUser{}
+	assert.Equal(t, 0, len(ms.InsertForm(&u, Map{"email": "a@b.com"})))
+
+	errs := ms.InsertForm(&uniqUser{}, Map{"email": "a@b.com"})
+	assert.Equal(t, []ErrorPlus{{Message: "already taken", Source: "email"}}, errs)
+
+	// The document being updated does not count
+	errs = ms.UpdateForm(&uniqUser{}, bson.M{"_id": u.ID}, Map{"email": "a@b.com"})
+	assert.Equal(t, 0, len(errs))
+
+	v := uniqUser{}
+	ms.InsertForm(&v, Map{"email": "c@d.com"})
+	errs = ms.UpdateForm(&uniqUser{}, bson.M{"_id": v.ID}, Map{"email": "a@b.com"})
+	assert.Equal(t, []ErrorPlus{{Message: "already taken", Source: "email"}}, errs)
+}
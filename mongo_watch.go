@@ -0,0 +1,209 @@
+package do
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+	CHANGE STREAMS
+
+	Watch subscribes to changes of a model's collection. Resume
+	tokens are saved (by subscription name) in the watch_tokens
+	collection, after every handled change, so that a restarted
+	process carries on from where it stopped
+*/
+
+const watchTokenColl = "watch_tokens"
+
+type WatchEvent struct {
+	Operation string      // insert | update | replace | delete
+	ID        interface{} // _id of the changed document
+	Document  interface{} // pointer to model (nil for deletes)
+}
+
+type WatchOptions struct {
+	// Name under which the resume token is saved. Without a
+	// name, the stream starts fresh every time
+	Name string
+
+	// Filter on change events (e.g. operationType, fullDocument.*)
+	Filter interface{}
+}
+
+type Watcher struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	mu     sync.Mutex
+	err    error
+}
+
+// Stops the subscription, and waits for the handler to
+// return from the change being processed
+func (w *Watcher) Close() error {
+	w.cancel()
+	<-w.done
+	return w.Err()
+}
+
+// Done is closed when the subscription ends
+func (w *Watcher) Done() <-chan struct{} {
+	return w.done
+}
+
+// Reason the subscription ended (once Done)
+func (w *Watcher) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+func (w *Watcher) setErr(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.err = err
+}
+
+func (mc *MongoConnect) Watch(model interface{}, opt WatchOptions, handler func(WatchEvent) error) (*Watcher, error) {
+	return mc.WatchCtx(context.Background(), model, opt, handler)
+}
+
+// Subscribes handler to changes of model's collection. Full
+// documents are decoded into new instances of model. The
+// subscription ends when ctx is done, Close is called, or
+// handler returns an error
+func (mc *MongoConnect) WatchCtx(ctx context.Context, model interface{}, opt WatchOptions, handler func(WatchEvent) error) (*Watcher, error) {
+
+	mc = mc.forModel(model)
+
+	pipeline := mongo.Pipeline{}
+	if opt.Filter != nil {
+		pipeline = append(pipeline, bson.D{{Key: "$match", Value: opt.Filter}})
+	}
+
+	streamOpts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	if opt.Name != "" {
+		token, err := mc.watchToken(ctx, model, opt.Name)
+		if err != nil {
+			return nil, err
+		}
+		if token != nil {
+			streamOpts.SetResumeAfter(token)
+		}
+	}
+
+	stream, err := mc.Collection(model).Watch(ctx, pipeline, streamOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	w := &Watcher{cancel: cancel, done: make(chan struct{})}
+	itemType := TypeDereference(TypeOf(model))
+
+	var save func(bson.Raw)
+	if opt.Name != "" {
+		save = func(token bson.Raw) {
+			if err := mc.saveWatchToken(model, opt.Name, token); err != nil {
+				log.Error().
+					Err(err).
+					Str("watch", opt.Name).
+					Msg("unable to save resume token")
+			}
+		}
+	}
+
+	go func() {
+		defer close(w.done)
+		defer stream.Close(context.Background())
+
+		w.setErr(watchLoop(ctx, stream, itemType, handler, save))
+	}()
+
+	return w, nil
+}
+
+// Change stream, as watchLoop uses it
+type changeStream interface {
+	Next(ctx context.Context) bool
+	Decode(val interface{}) error
+	ResumeToken() bson.Raw
+	Err() error
+}
+
+// Hands every change of the stream to handler, saving the
+// resume token after each (if save is given). Returns why
+// the stream ended: nil when ctx was cancelled
+func watchLoop(ctx context.Context, stream changeStream, itemType reflect.Type, handler func(WatchEvent) error, save func(bson.Raw)) error {
+
+	for stream.Next(ctx) {
+		change := struct {
+			Operation string   `bson:"operationType"`
+			Key       bson.M   `bson:"documentKey"`
+			Full      bson.Raw `bson:"fullDocument"`
+		}{}
+		if err := stream.Decode(&change); err != nil {
+			return err
+		}
+
+		event := WatchEvent{Operation: change.Operation, ID: change.Key["_id"]}
+		if len(change.Full) > 0 {
+			item := reflect.New(itemType).Interface()
+			err := bson.Unmarshal(change.Full, item)
+			if err == nil {
+				err = decryptFields(item)
+			}
+			if err != nil {
+				return err
+			}
+			event.Document = item
+		}
+
+		if err := handler(event); err != nil {
+			return err
+		}
+
+		if save != nil {
+			save(stream.ResumeToken())
+		}
+	}
+
+	// Ending because of Close (or ctx) is a clean end
+	if err := stream.Err(); err != nil && !errors.Is(err, context.Canceled) {
+		return err
+	}
+	return nil
+}
+
+func watchTokenID(model interface{}, name string) string {
+	return MongoCollectionName(model) + ":" + name
+}
+
+func (mc *MongoConnect) watchToken(ctx context.Context, model interface{}, name string) (bson.Raw, error) {
+	saved := struct {
+		Token bson.Raw `bson:"token"`
+	}{}
+
+	err := mc.Collection(watchTokenColl).FindOne(ctx, bson.M{"_id": watchTokenID(model, name)}).Decode(&saved)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	return saved.Token, err
+}
+
+func (mc *MongoConnect) saveWatchToken(model interface{}, name string, token bson.Raw) error {
+	_, err := mc.Collection(watchTokenColl).UpdateOne(context.Background(),
+		bson.M{"_id": watchTokenID(model, name)},
+		bson.M{"$set": bson.M{"token": token, "updated_at": time.Now()}},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
@@ -0,0 +1,113 @@
+package do
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type watchItem struct {
+	MongoEntity
+	ID   string `bson:"_id" json:"id"`
+	Name string `bson:"name" json:"name"`
+}
+
+// Change stream over a fixed list of events
+type fakeChangeStream struct {
+	events []bson.M
+	next   int
+	err    error
+}
+
+func (fs *fakeChangeStream) Next(ctx context.Context) bool {
+	if fs.next >= len(fs.events) {
+		return false
+	}
+	fs.next++
+	return true
+}
+
+func (fs *fakeChangeStream) Decode(val interface{}) error {
+	b, err := bson.Marshal(fs.events[fs.next-1])
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(b, val)
+}
+
+func (fs *fakeChangeStream) ResumeToken() bson.Raw {
+	b, _ := bson.Marshal(bson.M{"_data": fs.next})
+	return b
+}
+
+func (fs *fakeChangeStream) Err() error {
+	return fs.err
+}
+
+func TestWatchTokenID(t *testing.T) {
+	assert.Equal(t, "watch_item:billing", watchTokenID(watchItem{}, "billing"))
+	assert.Equal(t, "watch_item:billing", watchTokenID(&watchItem{}, "billing"))
+}
+
+func TestWatchLoop(t *testing.T) {
+
+	stream := &fakeChangeStream{events: []bson.M{
+		{"operationType": "insert", "documentKey": bson.M{"_id": "w1"}, "fullDocument": bson.M{"_id": "w1", "name": "abc"}},
+		{"operationType": "delete", "documentKey": bson.M{"_id": "w1"}},
+	}}
+
+	events := []WatchEvent{}
+	tokens := []int32{}
+	err := watchLoop(context.Background(), stream, reflect.TypeOf(watchItem{}), func(e WatchEvent) error {
+		events = append(events, e)
+		return nil
+	}, func(token bson.Raw) {
+		tokens = append(tokens, token.Lookup("_data").Int32())
+	})
+	assert.Nil(t, err)
+
+	// Full documents are decoded into the model
+	assert.Equal(t, 2, len(events))
+	assert.Equal(t, "insert", events[0].Operation)
+	assert.Equal(t, "w1", events[0].ID)
+	assert.Equal(t, &watchItem{ID: "w1", Name: "abc"}, events[0].Document)
+	assert.Equal(t, "delete", events[1].Operation)
+	assert.Nil(t, events[1].Document)
+
+	// Token saved after every handled change
+	assert.Equal(t, []int32{1, 2}, tokens)
+
+	// A failing handler ends the loop, without saving
+	// the token of the change it failed on
+	stream = &fakeChangeStream{events: stream.events}
+	tokens = nil
+	err = watchLoop(context.Background(), stream, reflect.TypeOf(watchItem{}), func(e WatchEvent) error {
+		return errors.New("boom")
+	}, func(token bson.Raw) {
+		tokens = append(tokens, token.Lookup("_data").Int32())
+	})
+	assert.Equal(t, "boom", err.Error())
+	assert.Equal(t, 0, len(tokens))
+
+	// Errors of the stream end it, unless it was cancelled
+	err = watchLoop(context.Background(), &fakeChangeStream{err: errors.New("lost")}, reflect.TypeOf(watchItem{}), nil, nil)
+	assert.Equal(t, "lost", err.Error())
+	err = watchLoop(context.Background(), &fakeChangeStream{err: context.Canceled}, reflect.TypeOf(watchItem{}), nil, nil)
+	assert.Nil(t, err)
+}
+
+func TestWatcherErr(t *testing.T) {
+
+	// Err may be read while the subscription runs
+	w := &Watcher{cancel: func() {}, done: make(chan struct{})}
+	go func() {
+		w.setErr(errors.New("boom"))
+		close(w.done)
+	}()
+	_ = w.Err()
+	assert.Equal(t, "boom", w.Close().Error())
+}
@@ -0,0 +1,231 @@
+package do
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+/*
+	PROJECTION
+
+	QueryOptions.Projection is a bson.M of field paths,
+	either all included (1) or all excluded (0).
+
+	Fields tagged select:"never" (e.g. password hashes,
+	large blobs) are left out of every query, whatever
+	the projection asks for
+*/
+
+// Builds the projection asked for with ?:fields=name,email,address.city
+// (json keys, projected by their bson paths), for QueryOptions.
+// Returns nil if there is no such parameter
+func ExtractQueryProjection(c echo.Context, modelType interface{}) (bson.M, error) {
+	return extractQueryFields(c, modelType)
+}
+
+func extractQueryFields(c echo.Context, modelType interface{}) (bson.M, error) {
+	param := strings.TrimSpace(c.QueryParam(":fields"))
+	if param == "" {
+		return nil, nil
+	}
+
+	_, never := selectPaths(TypeDereference(TypeOf(modelType)), "")
+
+	projection := bson.M{}
+	for _, f := range strings.Split(param, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		path, found := bsonPath(modelType, f)
+		if !found || selectNever(never, path) {
+			return nil, ErrorPlus{Message: fmt.Sprintf("unknown field '%s'", f), Source: ":fields"}
+		}
+		projection[path] = 1
+	}
+
+	return projection, nil
+}
+
+// Bson path of the field at a json key path (e.g. id
+// gives _id)
+func bsonPath(modelType interface{}, path string) (string, bool) {
+	if path == "id" || path == "_id" {
+		return "_id", true
+	}
+
+	t := TypeDereference(TypeOf(modelType))
+	keys := []string{}
+	for _, part := range strings.Split(path, ".") {
+		for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct || TypeIsTime(t) {
+			return "", false
+		}
+		fld, found := aggregateFieldByKey(t, part)
+		if !found {
+			return "", false
+		}
+		key, _ := bsonFieldKey(fld)
+		if key == "" || key == "-" {
+			return "", false
+		}
+		keys = append(keys, key)
+		t = fld.Type
+	}
+	return strings.Join(keys, "."), true
+}
+
+// Projection to query the model with, given the one asked
+// for: select:"never" fields are always left out. Returns
+// nil when all fields are to be returned
+func queryProjection(model interface{}, projection bson.M) bson.M {
+	if _, isName := model.(string); isName {
+		return projection
+	}
+
+	paths, never := selectPaths(TypeDereference(TypeOf(model)), "")
+	if len(never) == 0 {
+		return projection
+	}
+
+	output := bson.M{}
+
+	// Exclusion: add the never fields to it
+	if !projectionIncludes(projection) {
+		for k, v := range projection {
+			output[k] = v
+		}
+		for _, n := range never {
+			if !selectNever(projectionKeys(output), n) {
+				output[n] = 0
+			}
+		}
+		return output
+	}
+
+	// Inclusion: drop never fields, and replace parents of never
+	// fields with their other children
+	var include func(key string, v interface{})
+	include = func(key string, v interface{}) {
+		if selectNever(never, key) {
+			return
+		}
+		parent := false
+		for _, n := range never {
+			if strings.HasPrefix(n, key+".") {
+				parent = true
+				break
+			}
+		}
+		if !parent {
+			output[key] = v
+			return
+		}
+		for _, p := range paths {
+			if strings.HasPrefix(p, key+".") && !strings.Contains(p[len(key)+1:], ".") {
+				include(p, v)
+			}
+		}
+	}
+	for k, v := range projection {
+		include(k, v)
+	}
+	return output
+}
+
+// Does projection include fields (rather than exclude them)?
+// One of only _id is an inclusion, unless it excludes _id
+func projectionIncludes(projection bson.M) bool {
+	for k, v := range projection {
+		if k != "_id" {
+			return projectionTruthy(v)
+		}
+	}
+	if v, ok := projection["_id"]; ok {
+		return projectionTruthy(v)
+	}
+	return false
+}
+
+func projectionTruthy(v interface{}) bool {
+	switch val := v.(type) {
+	case bool:
+		return val
+	case int:
+		return val != 0
+	case int32:
+		return val != 0
+	case int64:
+		return val != 0
+	case float64:
+		return val != 0
+	}
+	// expressions ($slice, $elemMatch etc)
+	return true
+}
+
+func projectionKeys(projection bson.M) []string {
+	keys := []string{}
+	for k := range projection {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// Is path a never selected field (or under one)?
+func selectNever(never []string, path string) bool {
+	for _, n := range never {
+		if path == n || strings.HasPrefix(path, n+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// All field paths (bson keys) of a struct, nested ones
+// included, along with those tagged select:"never"
+func selectPaths(t reflect.Type, prefix string) (paths []string, never []string) {
+	if t.Kind() != reflect.Struct {
+		return
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		fld := t.Field(i)
+		key, inline := bsonFieldKey(fld)
+		if key == "-" || (fld.PkgPath != "" && !fld.Anonymous) {
+			continue
+		}
+
+		sub := prefix
+		if !inline {
+			if prefix != "" {
+				key = prefix + "." + key
+			}
+			sub = key
+			if fld.Tag.Get("select") == "never" {
+				never = append(never, key)
+			}
+			paths = append(paths, key)
+		}
+
+		ft := fld.Type
+		for ft.Kind() == reflect.Ptr || ft.Kind() == reflect.Slice || ft.Kind() == reflect.Array {
+			ft = ft.Elem()
+		}
+		if ft.Kind() == reflect.Struct && !TypeIsTime(ft) {
+			p, n := selectPaths(ft, sub)
+			paths = append(paths, p...)
+			never = append(never, n...)
+		}
+	}
+
+	sort.Strings(paths)
+	return
+}
@@ -0,0 +1,80 @@
+package do
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type projAccount struct {
+	ID       string `bson:"_id" json:"id"`
+	Name     string `bson:"name" json:"name"`
+	Email    string `bson:"email_address" json:"email"`
+	Password string `bson:"password" json:"password" select:"never"`
+	Address  struct {
+		City string `bson:"city" json:"city"`
+		Pin  string `bson:"pin" json:"pin" select:"never"`
+	} `bson:"address" json:"address"`
+}
+
+func TestExtractQueryFields(t *testing.T) {
+
+	e := echo.New()
+	fields := func(q string) (bson.M, error) {
+		req := httptest.NewRequest("GET", "/?"+q, nil)
+		p, err := ExtractQueryProjection(e.NewContext(req, httptest.NewRecorder()), projAccount{})
+		return p, err
+	}
+
+	// Json keys, projected by their bson paths
+	p, err := fields(":fields=name,email,address.city")
+	assert.Nil(t, err)
+	assert.Equal(t, bson.M{"name": 1, "email_address": 1, "address.city": 1}, p)
+
+	p, err = fields(":fields=id")
+	assert.Nil(t, err)
+	assert.Equal(t, bson.M{"_id": 1}, p)
+	assert.True(t, projectionIncludes(p))
+	assert.Equal(t, bson.M{"_id": "a"}, memoryProject(bson.M{"_id": "a", "name": "abc"}, p))
+
+	p, err = fields("name=abc")
+	assert.Nil(t, err)
+	assert.Nil(t, p)
+
+	// Unknown and never selected fields
+	_, err = fields(":fields=name,age")
+	assert.NotNil(t, err)
+	_, err = fields(":fields=password")
+	assert.NotNil(t, err)
+}
+
+func TestQueryProjection(t *testing.T) {
+
+	// Never selected fields are excluded by default
+	assert.Equal(t, bson.M{"password": 0, "address.pin": 0}, queryProjection(projAccount{}, nil))
+	assert.Equal(t, bson.M{"email_address": 0, "password": 0, "address.pin": 0}, queryProjection(projAccount{}, bson.M{"email_address": 0}))
+	assert.Equal(t, bson.M{"address": 0, "password": 0}, queryProjection(projAccount{}, bson.M{"address": 0}))
+
+	// and dropped from inclusions (parents get expanded)
+	assert.Equal(t, bson.M{"name": 1}, queryProjection(projAccount{}, bson.M{"name": 1, "password": 1}))
+	assert.Equal(t, bson.M{"address.city": 1}, queryProjection(projAccount{}, bson.M{"address": 1}))
+
+	// Models without such fields are left alone
+	assert.Nil(t, queryProjection(memTicket{}, nil))
+	assert.Equal(t, bson.M{"title": 1}, queryProjection("tickets", bson.M{"title": 1}))
+}
+
+func TestMemoryProject(t *testing.T) {
+
+	doc := bson.M{"_id": "a", "name": "abc", "address": bson.M{"city": "pune", "pin": "411"}}
+
+	assert.Equal(t, bson.M{"_id": "a", "address": bson.M{"city": "pune"}}, memoryProject(doc, bson.M{"address.city": 1}))
+	assert.Equal(t, bson.M{"name": "abc"}, memoryProject(doc, bson.M{"name": 1, "_id": 0}))
+	assert.Equal(t, bson.M{"_id": "a", "name": "abc", "address": bson.M{"city": "pune"}}, memoryProject(doc, bson.M{"address.pin": 0}))
+
+	// Original is untouched
+	assert.Equal(t, "411", doc["address"].(bson.M)["pin"])
+}
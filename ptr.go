@@ -7,3 +7,7 @@ func P_int64(i int64) *int64 {
 func P_int(i int) *int {
 	return &i
 }
+
+func P_int32(i int32) *int32 {
+	return &i
+}
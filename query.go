@@ -7,6 +7,10 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 )
 
+// Builds the query and sort asked for with the parameters of
+// the request: field[:op]=value and field:ord=1|-1. Filters on
+// encrypted fields that can't be searched match nothing (rather
+// than being dropped). See ExtractQueryProjection for :fields
 func ExtractQueryBson(c echo.Context, modelType interface{}) (query bson.D, sort bson.M) {
 	query = bson.D{}
 	sort = bson.M{}
@@ -15,7 +19,7 @@ func ExtractQueryBson(c echo.Context, modelType interface{}) (query bson.D, sort
 	for k, vals := range params {
 		for _, v := range vals {
 			if strings.HasPrefix(k, ":") {
-				// :page or :chunk, so not part of sql quering
+				// :page, :chunk or :fields, so not part of sql quering
 				continue
 			}
 			split := strings.Split(k, ":")
@@ -25,6 +29,25 @@ func ExtractQueryBson(c echo.Context, modelType interface{}) (query bson.D, sort
 				op = split[1]
 			}
 
+			// Encrypted fields are only searched by equality,
+			// through their blind index
+			if _, encrypted := encryptedField(modelType, key); encrypted {
+				var cond bson.M
+				var err error
+				if op == "" || op == "eq" {
+					cond, err = EncryptedEquals(modelType, key, v)
+				}
+				if cond == nil || err != nil {
+					// TODO: log
+					query = append(query, bson.E{Key: key, Value: bson.M{"$in": bson.A{}}})
+					continue
+				}
+				for k, val := range cond {
+					query = append(query, bson.E{Key: k, Value: val})
+				}
+				continue
+			}
+
 			switch op {
 			case "", "eq":
 				query = append(query, bson.E{Key: key, Value: v})
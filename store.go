@@ -0,0 +1,15 @@
+package do
+
+import "go.mongodb.org/mongo-driver/mongo"
+
+// Store is what services need of a database. MongoConnect is
+// the real one, while MemoryStore lets tests run without a DB
+type Store interface {
+	Query(model interface{}, addrSlice interface{}, opts ...QueryOptions) (int, error)
+	InsertForm(addrObject interface{}, inputs Map, sessCtx ...mongo.SessionContext) []ErrorPlus
+	UpdateForm(addrObject interface{}, queryOne interface{}, inputs Map, sessCtx ...mongo.SessionContext) []ErrorPlus
+	DeleteForm(addrObject interface{}, queryOne interface{}, sessCtx ...mongo.SessionContext) []ErrorPlus
+	Transactionally(doAction func(sessCtx mongo.SessionContext) error) error
+}
+
+var _ Store = &MongoConnect{}
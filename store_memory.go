@@ -0,0 +1,1166 @@
+package do
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"errors"
+
+	"github.com/rightjoin/fig"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+	MEMORY STORE
+
+	In-memory Store for tests. Documents go through the same
+	validations (and state machine checks) as with MongoConnect.
+	Filters support the subset ExtractQueryBson produces, plus
+	a little more:
+
+		field: value (equality, nil matches missing)
+		$eq $ne $lt $lte $gt $gte $in $nin
+		$and $or
+
+	Transactions are emulated by undoing the changes the action
+	made, when it fails. Changes made meanwhile by others stay.
+	Audited models get their records in <collection>_audit
+*/
+
+type MemoryStore struct {
+	mu   sync.Mutex
+	data map[string][]bson.M
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{data: map[string][]bson.M{}}
+}
+
+var _ Store = &MemoryStore{}
+
+// Change made in a transaction, undone should it fail
+type memoryUndo struct {
+	coll   string
+	id     interface{}
+	before bson.M // nil if the document was inserted
+}
+
+// Session of a transaction, recording the changes made in it.
+// Transactions are run by Transactionally, so the methods to
+// start or end one fail. The embedded Session is never set
+// (it only provides the unexported method of mongo.Session)
+type memorySession struct {
+	mongo.Session
+	undo []memoryUndo
+}
+
+var errMemorySession = errors.New("memory store transactions are run by Transactionally")
+
+func (s *memorySession) StartTransaction(...*options.TransactionOptions) error {
+	return errMemorySession
+}
+
+func (s *memorySession) AbortTransaction(context.Context) error {
+	return errMemorySession
+}
+
+func (s *memorySession) CommitTransaction(context.Context) error {
+	return errMemorySession
+}
+
+// Runs fn as part of the transaction in progress
+func (s *memorySession) WithTransaction(ctx context.Context, fn func(sessCtx mongo.SessionContext) (interface{}, error), opts ...*options.TransactionOptions) (interface{}, error) {
+	return fn(mongo.NewSessionContext(ctx, s))
+}
+
+func (s *memorySession) EndSession(context.Context) {}
+
+func (s *memorySession) ClusterTime() bson.Raw {
+	return nil
+}
+
+func (s *memorySession) OperationTime() *primitive.Timestamp {
+	return nil
+}
+
+func (s *memorySession) Client() *mongo.Client {
+	return nil
+}
+
+func (s *memorySession) ID() bson.Raw {
+	return nil
+}
+
+func (s *memorySession) AdvanceClusterTime(bson.Raw) error {
+	return nil
+}
+
+func (s *memorySession) AdvanceOperationTime(*primitive.Timestamp) error {
+	return nil
+}
+
+func (ms *MemoryStore) Transactionally(doAction func(sessCtx mongo.SessionContext) error) error {
+
+	sess := &memorySession{}
+	err := doAction(mongo.NewSessionContext(context.Background(), sess))
+	if err != nil {
+		ms.rollback(sess)
+	}
+
+	return err
+}
+
+// Runs fn in the transaction of sessCtx, if given, or else
+// in a new one
+func (ms *MemoryStore) inTransaction(fn func(tx *memorySession) error, sessCtx []mongo.SessionContext) error {
+	if len(sessCtx) > 0 {
+		return fn(memorySessionOf(sessCtx[0]))
+	}
+	return ms.Transactionally(func(sessCtx mongo.SessionContext) error {
+		return fn(memorySessionOf(sessCtx))
+	})
+}
+
+// Session of a memory store transaction (nil for others)
+func memorySessionOf(sessCtx mongo.SessionContext) *memorySession {
+	sess, _ := mongo.SessionFromContext(sessCtx).(*memorySession)
+	return sess
+}
+
+// Undoes changes of the transaction, latest first
+func (ms *MemoryStore) rollback(tx *memorySession) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		u := tx.undo[i]
+		j := ms.findID(u.coll, u.id)
+		switch {
+		case u.before == nil && j >= 0:
+			ms.data[u.coll] = append(append([]bson.M{}, ms.data[u.coll][:j]...), ms.data[u.coll][j+1:]...)
+		case u.before != nil && j >= 0:
+			ms.data[u.coll][j] = u.before
+		case u.before != nil:
+			ms.data[u.coll] = append(ms.data[u.coll], u.before)
+		}
+	}
+	tx.undo = nil
+}
+
+// Writes (inserts, or replaces the document with the same _id),
+// recording the change in tx. Caller must hold the lock
+func (ms *MemoryStore) put(tx *memorySession, coll string, doc bson.M) {
+	i := ms.findID(coll, doc["_id"])
+	if tx != nil {
+		var before bson.M
+		if i >= 0 {
+			before = ms.data[coll][i]
+		}
+		tx.undo = append(tx.undo, memoryUndo{coll: coll, id: doc["_id"], before: before})
+	}
+	if i >= 0 {
+		ms.data[coll][i] = doc
+	} else {
+		ms.data[coll] = append(ms.data[coll], doc)
+	}
+}
+
+// Removes the document with the _id, recording the change
+// in tx. Caller must hold the lock
+func (ms *MemoryStore) remove(tx *memorySession, coll string, id interface{}) {
+	i := ms.findID(coll, id)
+	if i < 0 {
+		return
+	}
+	if tx != nil {
+		tx.undo = append(tx.undo, memoryUndo{coll: coll, id: id, before: ms.data[coll][i]})
+	}
+	docs := ms.data[coll]
+	ms.data[coll] = append(append([]bson.M{}, docs[:i]...), docs[i+1:]...)
+}
+
+func (ms *MemoryStore) Query(model interface{}, addrSlice interface{}, opts ...QueryOptions) (int, error) {
+
+	var opt = QueryOptions{}
+	if len(opts) != 0 {
+		opt = opts[0]
+	}
+	if opt.After != "" || opt.Before != "" {
+		return 0, errKeysetCursor
+	}
+
+	// Leave out soft deleted documents, unless asked for
+	if !opt.WithDeleted {
+		opt.Query = excludeSoftDeleted(model, opt.Query)
+	}
+
+	ms.mu.Lock()
+	found := []bson.M{}
+	for _, doc := range ms.data[MongoCollectionName(model)] {
+		if memoryMatch(doc, opt.Query) {
+			found = append(found, doc)
+		}
+	}
+	ms.mu.Unlock()
+
+	memorySort(found, opt.Sort)
+
+	total := len(found)
+	skip, limit := opt.Skip, opt.Limit
+	if opt.Paginate {
+		if opt.Page <= 0 {
+			opt.Page = 1
+		}
+		max := fig.IntOr(25, "pagination.chunk")
+		if opt.Chunk < 1 || opt.Chunk > max {
+			opt.Chunk = max
+		}
+		skip, limit = (opt.Page-1)*opt.Chunk, opt.Chunk
+	}
+	if skip > len(found) {
+		skip = len(found)
+	}
+	found = found[skip:]
+	if limit > 0 && limit < len(found) {
+		found = found[:limit]
+	}
+
+	projection := queryProjection(model, opt.Projection)
+	raws := make([]bson.Raw, len(found))
+	for i, doc := range found {
+		b, err := bson.Marshal(memoryProject(doc, projection))
+		if err != nil {
+			return 0, err
+		}
+		raws[i] = b
+	}
+	if err := decodeRawsInto(raws, addrSlice); err != nil {
+		return 0, err
+	}
+	if err := populateRefs(ms.refsFound, model, addrSlice, opt.Populate); err != nil {
+		return 0, err
+	}
+
+	if !opt.Paginate {
+		return 0, nil
+	}
+	return total, nil
+}
+
+func (ms *MemoryStore) InsertForm(addrObject interface{}, inputs Map, sessCtx ...mongo.SessionContext) []ErrorPlus {
+
+	// Validate inputs for validation errors before sending
+	// inputs to DB
+	errors := ModelValidateInputs(addrObject, DB_INSERT, inputs)
+	taken, err := uniqueErrors(addrObject, inputs, nil, ms.uniqueCounter(addrObject))
+	if err != nil {
+		return []ErrorPlus{{Message: err.Error()}}
+	}
+	errors = append(errors, taken...)
+	if len(errors) > 0 {
+		return errors
+	}
+
+	var manyErrs []ErrorPlus
+	fn := func(tx *memorySession) error {
+
+		// Referenced documents must exist
+		refErrs, err := refErrors(ms.refsFound, addrObject, inputs)
+		if err != nil {
+			return err
+		}
+		if len(refErrs[0]) > 0 {
+			manyErrs = refErrs[0]
+			return manyErrs[0]
+		}
+
+		// Insert
+		doc, err := memoryDoc(inputs)
+		if err != nil {
+			return err
+		}
+		if _, ok := doc["_id"]; !ok {
+			doc["_id"] = primitive.NewObjectID()
+		}
+		coll := MongoCollectionName(addrObject)
+		ms.mu.Lock()
+		if ms.findID(coll, doc["_id"]) >= 0 {
+			ms.mu.Unlock()
+			return fmt.Errorf("duplicate key: _id %v", doc["_id"])
+		}
+		ms.put(tx, coll, doc)
+		err = ms.audit(tx, addrObject, "insert", nil, doc)
+		ms.mu.Unlock()
+		if err != nil {
+			return err
+		}
+
+		// Read
+		if err = memoryDecode(doc, addrObject); err != nil {
+			return err
+		}
+
+		// Validate post inserting to DB
+		manyErrs = ModelValidateObject(addrObject)
+		if len(manyErrs) > 0 {
+			return manyErrs[0]
+		}
+
+		return nil
+	}
+
+	return memoryErrors(ms.inTransaction(fn, sessCtx), manyErrs)
+}
+
+func (ms *MemoryStore) UpdateForm(addrObject interface{}, queryOne interface{}, inputs Map, sessCtx ...mongo.SessionContext) []ErrorPlus {
+
+	// Validate inputs for validation errors before sending
+	// inputs to DB
+	errors := ModelValidateInputs(addrObject, DB_UPDATE, inputs)
+	taken, err := uniqueErrors(addrObject, inputs, queryOne, ms.uniqueCounter(addrObject))
+	if err != nil {
+		return []ErrorPlus{{Message: err.Error()}}
+	}
+	errors = append(errors, taken...)
+	if len(errors) > 0 {
+		return errors
+	}
+
+	// Soft deleted documents can not be updated (until restored)
+	queryOne = excludeSoftDeleted(addrObject, queryOne)
+
+	versioned := isVersioned(addrObject)
+	version := inputs["version"]
+
+	coll := MongoCollectionName(addrObject)
+	smFields := StateMachine{}.GetStateMachineFieldNames(addrObject)
+
+	var manyErrs []ErrorPlus
+	fn := func(tx *memorySession) error {
+
+		// Referenced documents must exist
+		refErrs, err := refErrors(ms.refsFound, addrObject, inputs)
+		if err != nil {
+			return err
+		}
+		if len(refErrs[0]) > 0 {
+			manyErrs = refErrs[0]
+			return manyErrs[0]
+		}
+
+		set, err := memoryDoc(inputs)
+		if err != nil {
+			return err
+		}
+		if versioned {
+			delete(set, "version")
+		}
+
+		ms.mu.Lock()
+		i := ms.find(coll, queryOne)
+		if i < 0 {
+			ms.mu.Unlock()
+			manyErrs = []ErrorPlus{ErrNotFound}
+			return manyErrs[0]
+		}
+		before := ms.data[coll][i]
+		ms.mu.Unlock()
+
+		if versioned && !memoryEqual(before["version"], version) {
+			manyErrs = []ErrorPlus{ErrConflict}
+			return manyErrs[0]
+		}
+
+		// State of object before update
+		if err = memoryDecode(before, addrObject); err != nil {
+			return err
+		}
+		smPreValues, err := stateMachineValues(addrObject, smFields)
+		if err != nil {
+			return err
+		}
+
+		// Update
+		after := bson.M{}
+		for k, v := range before {
+			after[k] = v
+		}
+		for k, v := range set {
+			after[k] = v
+		}
+		if versioned {
+			after["version"] = memoryInt(before["version"]) + 1
+		}
+		ms.mu.Lock()
+		ms.put(tx, coll, after)
+		err = ms.audit(tx, addrObject, "update", before, after)
+		ms.mu.Unlock()
+		if err != nil {
+			return err
+		}
+
+		// Read again (after update)
+		if err = memoryDecode(after, addrObject); err != nil {
+			return err
+		}
+
+		// Validate post inserting to DB
+		manyErrs = ModelValidateObject(addrObject)
+		if len(manyErrs) > 0 {
+			return manyErrs[0]
+		}
+
+		return checkStateTransitions(coll, smFields, smPreValues, addrObject)
+	}
+
+	return memoryErrors(ms.inTransaction(fn, sessCtx), manyErrs)
+}
+
+func (ms *MemoryStore) UpsertForm(addrObject interface{}, queryOne interface{}, inputs Map, sessCtx ...mongo.SessionContext) []ErrorPlus {
+
+	coll := MongoCollectionName(addrObject)
+	w := upsertDocument(addrObject, queryOne, inputs)
+	if len(w.insertErrs) > 0 && len(w.updateErrs) > 0 {
+		ms.mu.Lock()
+		i := ms.find(coll, excludeSoftDeleted(addrObject, queryOne))
+		ms.mu.Unlock()
+		if i < 0 {
+			return w.insertErrs
+		}
+		return w.updateErrs
+	}
+	taken, err := uniqueErrors(addrObject, w.data, queryOne, ms.uniqueCounter(addrObject))
+	if err != nil {
+		return []ErrorPlus{{Message: err.Error()}}
+	}
+	if len(taken) > 0 {
+		return taken
+	}
+
+	smFields := StateMachine{}.GetStateMachineFieldNames(addrObject)
+
+	var manyErrs []ErrorPlus
+	fn := func(tx *memorySession) error {
+
+		// Referenced documents must exist
+		refErrs, err := refErrors(ms.refsFound, addrObject, w.data)
+		if err != nil {
+			return err
+		}
+		if len(refErrs[0]) > 0 {
+			manyErrs = refErrs[0]
+			return manyErrs[0]
+		}
+
+		before, after, err := ms.upsert(tx, coll, queryOne, w)
+		if err != nil {
+			return err
+		}
+		switch {
+		case after == nil:
+			// Not there, and can't be created; or its version is stale
+			ms.mu.Lock()
+			i := ms.find(coll, excludeSoftDeleted(addrObject, queryOne))
+			ms.mu.Unlock()
+			if i < 0 {
+				manyErrs = w.insertErrs
+			} else {
+				manyErrs = []ErrorPlus{ErrConflict}
+			}
+			return manyErrs[0]
+		case before != nil && len(w.updateErrs) > 0:
+			// There, but can't be updated (and wasn't)
+			manyErrs = w.updateErrs
+			return manyErrs[0]
+		}
+
+		// Audit trail
+		operation := "update"
+		if before == nil {
+			operation = "insert"
+		}
+		ms.mu.Lock()
+		err = ms.audit(tx, addrObject, operation, before, after)
+		ms.mu.Unlock()
+		if err != nil {
+			return err
+		}
+
+		// State of object before update
+		var smPreValues map[string]string
+		if before != nil {
+			if err = memoryDecode(before, addrObject); err != nil {
+				return err
+			}
+			if smPreValues, err = stateMachineValues(addrObject, smFields); err != nil {
+				return err
+			}
+		}
+
+		// Read again (after write)
+		if err = memoryDecode(after, addrObject); err != nil {
+			return err
+		}
+
+		// Validate post writing to DB
+		manyErrs = ModelValidateObject(addrObject)
+		if len(manyErrs) > 0 {
+			return manyErrs[0]
+		}
+
+		if before != nil {
+			return checkStateTransitions(coll, smFields, smPreValues, addrObject)
+		}
+		return nil
+	}
+
+	return memoryErrors(ms.inTransaction(fn, sessCtx), manyErrs)
+}
+
+// Applies the write of an upsert in one go. Returns the document
+// before (nil if created) and after it (nil if neither matched
+// nor created)
+func (ms *MemoryStore) upsert(tx *memorySession, coll string, queryOne interface{}, w upsertWrite) (bson.M, bson.M, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	i := ms.find(coll, w.filter)
+	if i < 0 && !w.upsert {
+		return nil, nil, nil
+	}
+
+	var before bson.M
+	after := bson.M{}
+	if i >= 0 {
+		before = ms.data[coll][i]
+		for k, v := range before {
+			after[k] = v
+		}
+	} else {
+		// Equality fields of the query, and what only
+		// goes into new documents
+		for _, m := range []interface{}{upsertQueryFields(queryOne), w.update["$setOnInsert"]} {
+			doc, err := memoryDoc(m)
+			if err != nil {
+				return nil, nil, err
+			}
+			for k, v := range doc {
+				after[k] = v
+			}
+		}
+		if _, ok := after["_id"]; !ok {
+			after["_id"] = primitive.NewObjectID()
+		}
+	}
+
+	if set, ok := w.update["$set"]; ok {
+		doc, err := memoryDoc(set)
+		if err != nil {
+			return nil, nil, err
+		}
+		for k, v := range doc {
+			after[k] = v
+		}
+	}
+	if inc, ok := w.update["$inc"].(bson.M); ok {
+		for k, v := range inc {
+			after[k] = memoryInt(after[k]) + memoryInt(v)
+		}
+	}
+
+	ms.put(tx, coll, after)
+	return before, after, nil
+}
+
+func (ms *MemoryStore) DeleteForm(addrObject interface{}, queryOne interface{}, sessCtx ...mongo.SessionContext) []ErrorPlus {
+
+	// Soft deleted documents can not be deleted again
+	isSoft := isSoftDeletable(addrObject)
+	queryOne = excludeSoftDeleted(addrObject, queryOne)
+	coll := MongoCollectionName(addrObject)
+
+	var manyErrs []ErrorPlus
+	fn := func(tx *memorySession) error {
+
+		// Read (before delete)
+		ms.mu.Lock()
+		i := ms.find(coll, queryOne)
+		if i < 0 {
+			ms.mu.Unlock()
+			manyErrs = []ErrorPlus{ErrNotFound}
+			return manyErrs[0]
+		}
+		doc := ms.data[coll][i]
+		ms.mu.Unlock()
+
+		if err := memoryDecode(doc, addrObject); err != nil {
+			return err
+		}
+
+		// Validate before deleting from DB
+		manyErrs = ModelValidateDelete(addrObject)
+		if len(manyErrs) > 0 {
+			return manyErrs[0]
+		}
+
+		// Delete (or mark as deleted)
+		ms.mu.Lock()
+		if isSoft {
+			deleted := bson.M{}
+			for k, v := range doc {
+				deleted[k] = v
+			}
+			deleted["deleted_at"] = primitive.NewDateTimeFromTime(time.Now())
+			deleted["deleted_by"] = ""
+			ms.put(tx, coll, deleted)
+		} else {
+			ms.remove(tx, coll, doc["_id"])
+		}
+		err := ms.audit(tx, addrObject, "delete", doc, nil)
+		ms.mu.Unlock()
+		if err != nil {
+			return err
+		}
+
+		// Documents referring to this one (see RegisterModel)
+		manyErrs, err = applyDeletePolicies(memoryRefPolicies{ms: ms, tx: tx}, addrObject, doc["_id"], isSoft, "")
+		if err != nil {
+			return err
+		}
+		if len(manyErrs) > 0 {
+			return manyErrs[0]
+		}
+
+		// Validate post deleting from DB
+		manyErrs = ModelValidateDeleted(addrObject)
+		if len(manyErrs) > 0 {
+			return manyErrs[0]
+		}
+
+		return nil
+	}
+
+	return memoryErrors(ms.inTransaction(fn, sessCtx), manyErrs)
+}
+
+// Delete policies, run in the transaction of the delete
+type memoryRefPolicies struct {
+	ms *MemoryStore
+	tx *memorySession
+}
+
+func (p memoryRefPolicies) countRefs(model interface{}, filter bson.M) (int64, error) {
+	ids, err := p.refIDs(model, filter)
+	return int64(len(ids)), err
+}
+
+func (p memoryRefPolicies) refIDs(model interface{}, filter bson.M) ([]interface{}, error) {
+	p.ms.mu.Lock()
+	defer p.ms.mu.Unlock()
+
+	ids := []interface{}{}
+	for _, doc := range p.ms.data[MongoCollectionName(model)] {
+		if memoryMatch(doc, excludeSoftDeleted(model, filter)) {
+			ids = append(ids, doc["_id"])
+		}
+	}
+	return ids, nil
+}
+
+func (p memoryRefPolicies) deleteRef(model interface{}, id interface{}, deletedBy string) []ErrorPlus {
+	object := reflect.New(TypeDereference(TypeOf(model))).Interface()
+	sessCtx := []mongo.SessionContext{}
+	if p.tx != nil {
+		sessCtx = append(sessCtx, mongo.NewSessionContext(context.Background(), p.tx))
+	}
+	return p.ms.DeleteForm(object, bson.M{"_id": id}, sessCtx...)
+}
+
+func (p memoryRefPolicies) unsetRefs(rf referrer, id interface{}) error {
+	p.ms.mu.Lock()
+	defer p.ms.mu.Unlock()
+
+	coll := MongoCollectionName(rf.model)
+	for _, doc := range p.ms.data[coll] {
+		if !memoryMatch(doc, bson.M{rf.ref.key: id}) {
+			continue
+		}
+		after := bson.M{}
+		for k, v := range doc {
+			after[k] = v
+		}
+		if rf.ref.many {
+			kept := bson.A{}
+			for _, v := range memoryList(doc[rf.ref.key]) {
+				if !memoryEqual(v, id) {
+					kept = append(kept, v)
+				}
+			}
+			after[rf.ref.key] = kept
+		} else {
+			after[rf.ref.key] = nil
+		}
+		if isVersioned(rf.model) {
+			after["version"] = memoryInt(after["version"]) + 1
+		}
+		p.ms.put(p.tx, coll, after)
+		if err := p.ms.audit(p.tx, rf.model, "update", doc, after); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Records the change in the audit collection of the model, if
+// it is Audited. Caller must hold the lock
+func (ms *MemoryStore) audit(tx *memorySession, model interface{}, operation string, before, after bson.M) error {
+	if !isAudited(model) {
+		return nil
+	}
+	record, err := memoryDoc(newAuditRecord(context.Background(), operation, before, after))
+	if err != nil {
+		return err
+	}
+	ms.put(tx, auditCollectionName(model), record)
+	return nil
+}
+
+// Documents of a collection with given ids (see refFetcher)
+func (ms *MemoryStore) refsFound(target interface{}, coll string, ids []interface{}, projection bson.M) (map[string]bson.Raw, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	found := map[string]bson.Raw{}
+	for _, doc := range ms.data[coll] {
+		for _, id := range ids {
+			if !memoryEqual(doc["_id"], id) {
+				continue
+			}
+			b, err := bson.Marshal(memoryProject(doc, projection))
+			if err != nil {
+				return nil, err
+			}
+			found[refKey(id)] = b
+		}
+	}
+	return found, nil
+}
+
+func (ms *MemoryStore) uniqueCounter(model interface{}) func(filter interface{}) (int64, error) {
+	return func(filter interface{}) (int64, error) {
+		ms.mu.Lock()
+		defer ms.mu.Unlock()
+
+		n := int64(0)
+		for _, doc := range ms.data[MongoCollectionName(model)] {
+			if memoryMatch(doc, filter) {
+				n++
+			}
+		}
+		return n, nil
+	}
+}
+
+// Index of the document with the _id (or -1).
+// Caller must hold the lock
+func (ms *MemoryStore) findID(coll string, id interface{}) int {
+	for i, doc := range ms.data[coll] {
+		if memoryEqual(doc["_id"], id) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Index of the first document matching filter (or -1).
+// Caller must hold the lock
+func (ms *MemoryStore) find(coll string, filter interface{}) int {
+	for i, doc := range ms.data[coll] {
+		if memoryMatch(doc, filter) {
+			return i
+		}
+	}
+	return -1
+}
+
+func memoryErrors(err error, manyErrs []ErrorPlus) []ErrorPlus {
+	if err != nil {
+		if manyErrs != nil && len(manyErrs) > 0 && manyErrs[0] == err {
+			return manyErrs
+		} else {
+			return []ErrorPlus{{Message: err.Error()}}
+		}
+	}
+	return []ErrorPlus{}
+}
+
+// Round trip through bson, so that stored values have the
+// same types as those read from MongoDB
+func memoryDoc(v interface{}) (bson.M, error) {
+	b, err := bson.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	doc := bson.M{}
+	err = bson.Unmarshal(b, &doc)
+	return doc, err
+}
+
+func memoryDecode(doc bson.M, addrObject interface{}) error {
+	b, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	if err = bson.Unmarshal(b, addrObject); err != nil {
+		return err
+	}
+	return decryptFields(addrObject)
+}
+
+func memoryLookup(doc bson.M, path string) (interface{}, bool) {
+	var cur interface{} = doc
+	for _, part := range strings.Split(path, ".") {
+		sub, ok := cur.(bson.M)
+		if !ok {
+			return nil, false
+		}
+		if cur, ok = sub[part]; !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+// Applies a projection of plain field paths (included,
+// or excluded) to a copy of the document
+func memoryProject(doc bson.M, projection bson.M) bson.M {
+	if len(projection) == 0 {
+		return doc
+	}
+
+	includes := projectionIncludes(projection)
+	if !includes {
+		output := memoryCopy(doc)
+		for path := range projection {
+			if path == "_id" && projectionTruthy(projection[path]) {
+				continue
+			}
+			memoryUnset(output, strings.Split(path, "."))
+		}
+		return output
+	}
+
+	output := bson.M{}
+	if v, ok := doc["_id"]; ok {
+		output["_id"] = v
+	}
+	for path, v := range projection {
+		if path == "_id" && !projectionTruthy(v) {
+			delete(output, "_id")
+			continue
+		}
+		if val, found := memoryLookup(doc, path); found {
+			memorySet(output, strings.Split(path, "."), val)
+		}
+	}
+	return output
+}
+
+func memoryCopy(doc bson.M) bson.M {
+	output := bson.M{}
+	for k, v := range doc {
+		if sub, ok := v.(bson.M); ok {
+			v = memoryCopy(sub)
+		}
+		output[k] = v
+	}
+	return output
+}
+
+func memoryUnset(doc bson.M, parts []string) {
+	if len(parts) == 1 {
+		delete(doc, parts[0])
+		return
+	}
+	if sub, ok := doc[parts[0]].(bson.M); ok {
+		memoryUnset(sub, parts[1:])
+	}
+}
+
+func memorySet(doc bson.M, parts []string, val interface{}) {
+	if len(parts) == 1 {
+		doc[parts[0]] = val
+		return
+	}
+	sub, ok := doc[parts[0]].(bson.M)
+	if !ok {
+		sub = bson.M{}
+		doc[parts[0]] = sub
+	}
+	memorySet(sub, parts[1:], val)
+}
+
+// Filter given as bson.D, bson.M or map
+func memoryFilter(filter interface{}) (bson.D, bool) {
+	switch f := filter.(type) {
+	case nil:
+		return bson.D{}, true
+	case bson.D:
+		return f, true
+	case bson.M, map[string]interface{}, Map:
+		d := bson.D{}
+		for _, k := range aggregateKeys(f) {
+			d = append(d, bson.E{Key: k, Value: aggregateValue(f, k)})
+		}
+		return d, true
+	}
+	return nil, false
+}
+
+func memoryList(v interface{}) []interface{} {
+	switch l := v.(type) {
+	case bson.A:
+		return l
+	case []interface{}:
+		return l
+	}
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array {
+		out := make([]interface{}, rv.Len())
+		for i := range out {
+			out[i] = rv.Index(i).Interface()
+		}
+		return out
+	}
+	return nil
+}
+
+func memoryMatch(doc bson.M, filter interface{}) bool {
+	conds, ok := memoryFilter(filter)
+	if !ok {
+		return false
+	}
+
+	for _, c := range conds {
+		switch c.Key {
+		case "$and":
+			for _, sub := range memoryList(c.Value) {
+				if !memoryMatch(doc, sub) {
+					return false
+				}
+			}
+		case "$nor":
+			for _, sub := range memoryList(c.Value) {
+				if memoryMatch(doc, sub) {
+					return false
+				}
+			}
+		case "$or":
+			any := false
+			for _, sub := range memoryList(c.Value) {
+				if memoryMatch(doc, sub) {
+					any = true
+					break
+				}
+			}
+			if !any {
+				return false
+			}
+		default:
+			val, found := memoryLookup(doc, c.Key)
+			if !memoryMatchField(val, found, c.Value) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func memoryMatchField(val interface{}, found bool, cond interface{}) bool {
+
+	// Operators, or plain equality
+	ops, isDoc := memoryFilter(cond)
+	if !isDoc || len(ops) == 0 || !strings.HasPrefix(ops[0].Key, "$") {
+		return memoryFieldEqual(val, found, cond)
+	}
+
+	for _, op := range ops {
+		ok := false
+		switch op.Key {
+		case "$eq":
+			ok = memoryFieldEqual(val, found, op.Value)
+		case "$ne":
+			ok = !memoryFieldEqual(val, found, op.Value)
+		case "$in":
+			for _, v := range memoryList(op.Value) {
+				if memoryFieldEqual(val, found, v) {
+					ok = true
+					break
+				}
+			}
+		case "$nin":
+			ok = true
+			for _, v := range memoryList(op.Value) {
+				if memoryFieldEqual(val, found, v) {
+					ok = false
+					break
+				}
+			}
+		case "$lt", "$lte", "$gt", "$gte":
+			cmp, comparable := memoryCompare(val, op.Value)
+			ok = found && comparable &&
+				((op.Key == "$lt" && cmp < 0) || (op.Key == "$lte" && cmp <= 0) ||
+					(op.Key == "$gt" && cmp > 0) || (op.Key == "$gte" && cmp >= 0))
+		default:
+			return false
+		}
+		if !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// nil matches missing fields, and arrays match if any
+// element does
+func memoryFieldEqual(val interface{}, found bool, want interface{}) bool {
+	if want == nil {
+		return !found || val == nil
+	}
+	if !found {
+		return false
+	}
+	if memoryEqual(val, want) {
+		return true
+	}
+	if list := memoryList(val); list != nil {
+		for _, v := range list {
+			if memoryEqual(v, want) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func memoryEqual(a, b interface{}) bool {
+	if cmp, ok := memoryCompare(a, b); ok {
+		return cmp == 0
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func memoryNormalize(v interface{}) interface{} {
+	switch n := v.(type) {
+	case int:
+		return float64(n)
+	case int8:
+		return float64(n)
+	case int16:
+		return float64(n)
+	case int32:
+		return float64(n)
+	case int64:
+		return float64(n)
+	case uint:
+		return float64(n)
+	case uint8:
+		return float64(n)
+	case uint16:
+		return float64(n)
+	case uint32:
+		return float64(n)
+	case uint64:
+		return float64(n)
+	case float32:
+		return float64(n)
+	case primitive.DateTime:
+		return n.Time()
+	case *time.Time:
+		if n != nil {
+			return *n
+		}
+	}
+	return v
+}
+
+func memoryInt(v interface{}) int64 {
+	if f, ok := memoryNormalize(v).(float64); ok {
+		return int64(f)
+	}
+	return 0
+}
+
+// Compares numbers, strings, times and bools
+func memoryCompare(a, b interface{}) (int, bool) {
+	a, b = memoryNormalize(a), memoryNormalize(b)
+
+	switch x := a.(type) {
+	case float64:
+		if y, ok := b.(float64); ok {
+			switch {
+			case x < y:
+				return -1, true
+			case x > y:
+				return 1, true
+			}
+			return 0, true
+		}
+	case string:
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y), true
+		}
+	case time.Time:
+		if y, ok := b.(time.Time); ok {
+			switch {
+			case x.Before(y):
+				return -1, true
+			case x.After(y):
+				return 1, true
+			}
+			return 0, true
+		}
+	case bool:
+		if y, ok := b.(bool); ok {
+			switch {
+			case x == y:
+				return 0, true
+			case !x:
+				return -1, true
+			}
+			return 1, true
+		}
+	}
+
+	return 0, false
+}
+
+func memorySort(docs []bson.M, by interface{}) {
+	keys, ok := memoryFilter(by)
+	if !ok || len(keys) == 0 {
+		return
+	}
+
+	sort.SliceStable(docs, func(i, j int) bool {
+		for _, k := range keys {
+			a, _ := memoryLookup(docs[i], k.Key)
+			b, _ := memoryLookup(docs[j], k.Key)
+			cmp, _ := memoryCompare(a, b)
+			if cmp != 0 {
+				return cmp*keysetDirection(k.Value) < 0
+			}
+		}
+		return false
+	})
+}
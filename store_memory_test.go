@@ -0,0 +1,242 @@
+package do
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type memTicket struct {
+	MongoEntity
+	ID     string `bson:"_id" json:"id" insert:"no" auto:"prefix:t-;alphanum(6)"`
+	Title  string `bson:"title" json:"title" insert:"yes"`
+	Status string `bson:"status" json:"status" state_machine:"true"`
+	Votes  int    `bson:"votes" json:"votes"`
+	Timed  `bson:"inline"`
+}
+
+func TestMemoryStoreMatch(t *testing.T) {
+
+	doc := bson.M{"name": "abc", "age": int32(5), "tags": bson.A{"x", "y"}, "address": bson.M{"city": "pune"}}
+
+	assert.True(t, memoryMatch(doc, bson.D{{Key: "name", Value: "abc"}}))
+	assert.True(t, memoryMatch(doc, bson.D{{Key: "age", Value: bson.M{"$gte": 5}}}))
+	assert.False(t, memoryMatch(doc, bson.D{{Key: "age", Value: bson.M{"$lt": 5}}}))
+	assert.True(t, memoryMatch(doc, bson.D{{Key: "age", Value: bson.M{"$ne": 4}}}))
+	assert.True(t, memoryMatch(doc, bson.M{"tags": "y"}))
+	assert.True(t, memoryMatch(doc, bson.M{"address.city": "pune"}))
+	assert.True(t, memoryMatch(doc, bson.M{"deleted_at": nil}))
+	assert.True(t, memoryMatch(doc, bson.M{"$or": bson.A{bson.M{"name": "def"}, bson.M{"age": 5}}}))
+	assert.False(t, memoryMatch(doc, bson.M{"$and": bson.A{bson.M{"name": "abc"}, bson.M{"age": 6}}}))
+}
+
+func TestMemoryStore(t *testing.T) {
+
+	ms := NewMemoryStore()
+	UseStateMachineStore(ms)
+	defer UseStateMachineStore(nil)
+
+	errs := ms.InsertForm(&StateMachine{}, Map{
+		"entity":        "mem_ticket",
+		"field":         "status",
+		"all_states":    []string{"open", "closed"},
+		"start_states":  []string{"open"},
+		"default_state": "open",
+		"transitions":   []StateMachineMovement{{From: "open", To: "closed"}},
+	})
+	assert.Equal(t, 0, len(errs))
+
+	// Insert validations apply
+	{
+		errs := ms.InsertForm(&memTicket{}, Map{"votes": "3"})
+		assert.Equal(t, 1, len(errs))
+		assert.Equal(t, "title", errs[0].Source)
+
+		errs = ms.InsertForm(&memTicket{}, Map{"title": "abc", "status": "closed"})
+		assert.Equal(t, 1, len(errs))
+		assert.Equal(t, "status", errs[0].Source)
+	}
+
+	// Defaults, auto fields and conversions too
+	tk := memTicket{}
+	{
+		errs := ms.InsertForm(&tk, Map{"title": " abc ", "votes": "3"})
+		assert.Equal(t, 0, len(errs))
+		assert.Equal(t, "abc", tk.Title)
+		assert.Equal(t, "open", tk.Status)
+		assert.Equal(t, 3, tk.Votes)
+		assert.Regexp(t, `^t-`, tk.ID)
+
+		ms.InsertForm(&memTicket{}, Map{"title": "def", "votes": 1})
+	}
+
+	// Query with filter, sort and pagination
+	{
+		rows := []memTicket{}
+		total, err := ms.Query(memTicket{}, &rows, QueryOptions{
+			Query:    bson.D{{Key: "votes", Value: bson.M{"$gt": 0}}},
+			Sort:     bson.M{"votes": -1},
+			Paginate: true,
+			Chunk:    1,
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, 2, total)
+		assert.Equal(t, 1, len(rows))
+		assert.Equal(t, "abc", rows[0].Title)
+	}
+
+	// State transitions are checked, and a failed update
+	// leaves the document as it was
+	{
+		errs := ms.UpdateForm(&memTicket{}, bson.M{"_id": tk.ID}, Map{"status": "closed"})
+		assert.Equal(t, 0, len(errs))
+
+		errs = ms.UpdateForm(&memTicket{}, bson.M{"_id": tk.ID}, Map{"status": "open", "votes": 9})
+		assert.Equal(t, 1, len(errs))
+
+		rows := []memTicket{}
+		ms.Query(memTicket{}, &rows, QueryOptions{Query: bson.M{"_id": tk.ID}})
+		assert.Equal(t, "closed", rows[0].Status)
+		assert.Equal(t, 3, rows[0].Votes)
+	}
+
+	// Delete
+	{
+		errs := ms.DeleteForm(&memTicket{}, bson.M{"_id": tk.ID})
+		assert.Equal(t, 0, len(errs))
+
+		errs = ms.UpdateForm(&memTicket{}, bson.M{"_id": tk.ID}, Map{"votes": 1})
+		assert.Equal(t, []ErrorPlus{ErrNotFound}, errs)
+
+		errs = ms.DeleteForm(&memTicket{}, bson.M{"_id": tk.ID})
+		assert.Equal(t, []ErrorPlus{ErrNotFound}, errs)
+	}
+}
+
+type memAccount struct {
+	MongoEntity
+	ID        string `bson:"_id" json:"id" insert:"no" auto:"prefix:a-;alphanum(6)"`
+	Email     string `bson:"email" json:"email" insert:"yes"`
+	Plan      string `bson:"plan" json:"plan" default:"free"`
+	Logins    int    `bson:"logins" json:"logins"`
+	Versioned `bson:"inline"`
+}
+
+func TestMemoryStoreUpsert(t *testing.T) {
+
+	ms := NewMemoryStore()
+
+	// Concurrent upserts create a single document
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs := ms.UpsertForm(&memAccount{}, bson.M{"email": "a@b.com"}, Map{"logins": 1})
+			if len(errs) > 0 {
+				// version is needed once it exists
+				assert.Equal(t, "version", errs[0].Source)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1, len(ms.data["mem_account"]))
+
+	// Created with insert rules: defaults, auto fields, the
+	// query's fields and the initial version
+	rows := []memAccount{}
+	ms.Query(memAccount{}, &rows)
+	acc := rows[0]
+	assert.Equal(t, "a@b.com", acc.Email)
+	assert.Equal(t, "free", acc.Plan)
+	assert.Equal(t, 1, acc.Logins)
+	assert.Equal(t, 1, acc.Version)
+	assert.Regexp(t, `^a-`, acc.ID)
+
+	// Updated with update rules, given the version
+	errs := ms.UpsertForm(&acc, bson.M{"email": "a@b.com"}, Map{"logins": 2, "version": 1})
+	assert.Equal(t, 0, len(errs))
+	assert.Equal(t, 2, acc.Logins)
+	assert.Equal(t, 2, acc.Version)
+
+	errs = ms.UpsertForm(&memAccount{}, bson.M{"email": "a@b.com"}, Map{"logins": 3, "version": 1})
+	assert.Equal(t, []ErrorPlus{ErrConflict}, errs)
+
+	// By _id, the created document keeps it
+	errs = ms.UpsertForm(&acc, bson.M{"_id": "a-given"}, Map{"email": "c@d.com"})
+	assert.Equal(t, 0, len(errs))
+	assert.Equal(t, "a-given", acc.ID)
+	errs = ms.UpsertForm(&acc, bson.M{"_id": "a-given"}, Map{"logins": 5, "version": 1})
+	assert.Equal(t, 0, len(errs))
+	assert.Equal(t, 2, len(ms.data["mem_account"]))
+	assert.Equal(t, "c@d.com", acc.Email)
+	assert.Equal(t, 5, acc.Logins)
+
+	// Insert rules apply to new documents
+	errs = ms.UpsertForm(&acc, bson.M{"_id": "a-other"}, Map{"logins": 1})
+	assert.Equal(t, "email", errs[0].Source)
+}
+
+func TestMemoryStoreTransactionally(t *testing.T) {
+
+	ms := NewMemoryStore()
+
+	kept := memAccount{}
+	errs := ms.InsertForm(&kept, Map{"email": "kept@x.com"})
+	assert.Equal(t, 0, len(errs))
+
+	// A failed transaction undoes its own writes only, not
+	// those made meanwhile by others
+	others := make(chan struct{})
+	err := ms.Transactionally(func(sessCtx mongo.SessionContext) error {
+		if errs := ms.InsertForm(&memAccount{}, Map{"email": "undone@x.com"}, sessCtx); len(errs) > 0 {
+			return errs[0]
+		}
+		if errs := ms.UpdateForm(&memAccount{}, bson.M{"_id": kept.ID}, Map{"plan": "pro", "version": 1}, sessCtx); len(errs) > 0 {
+			return errs[0]
+		}
+		go func() {
+			ms.InsertForm(&memAccount{}, Map{"email": "other@x.com"})
+			close(others)
+		}()
+		<-others
+		return errors.New("failed")
+	})
+	assert.NotNil(t, err)
+
+	rows := []memAccount{}
+	ms.Query(memAccount{}, &rows, QueryOptions{Sort: bson.M{"email": 1}})
+	assert.Equal(t, 2, len(rows))
+	assert.Equal(t, "kept@x.com", rows[0].Email)
+	assert.Equal(t, "free", rows[0].Plan)
+	assert.Equal(t, "other@x.com", rows[1].Email)
+
+	// Deletes are undone too
+	err = ms.Transactionally(func(sessCtx mongo.SessionContext) error {
+		if errs := ms.DeleteForm(&memAccount{}, bson.M{"_id": kept.ID}, sessCtx); len(errs) > 0 {
+			return errs[0]
+		}
+		return errors.New("failed")
+	})
+	assert.NotNil(t, err)
+	rows = []memAccount{}
+	ms.Query(memAccount{}, &rows, QueryOptions{Query: bson.M{"_id": kept.ID}})
+	assert.Equal(t, 1, len(rows))
+
+	// The session has no driver behind it
+	ms.Transactionally(func(sessCtx mongo.SessionContext) error {
+		assert.NotNil(t, sessCtx.StartTransaction())
+		assert.NotNil(t, sessCtx.CommitTransaction(sessCtx))
+		assert.Nil(t, sessCtx.Client())
+		_, err := sessCtx.WithTransaction(sessCtx, func(sc mongo.SessionContext) (interface{}, error) {
+			return nil, nil
+		})
+		assert.Nil(t, err)
+		sessCtx.EndSession(sessCtx)
+		return nil
+	})
+}
@@ -30,11 +30,19 @@ func StructWalk(modelOrType interface{}, c WalkConfig, data Map, action FieldOp,
 	stype := TypeOf(modelOrType)
 	stype = TypeDereference(stype)
 
+	// Fields references get populated into are not
+	// stored, so never part of the data
+	populated := refSiblings(stype)
+
 	for i := 0; i < stype.NumField(); i++ {
 		fld := stype.Field(i)
 		fldName := c.FieldKey(fld)
 		fldType := TypeDereference(TypeOf(fld.Type))
 
+		if populated[i] {
+			continue
+		}
+
 		subKeys := keys
 		if fldName != "" {
 			subKeys = append(keys, fldName)
@@ -0,0 +1,191 @@
+package do
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rightjoin/fig"
+)
+
+/*
+	MULTI TENANCY
+
+	database.mongo.tenancy:
+		strategy: database | collection
+		source:   jwt (default) | header | subdomain
+		header:   X-Tenant (header to read)
+		claim:    tenant   (jwt claim to read)
+		context:  user     (context key under which a jwt
+		                   middleware stores the verified token)
+
+	With database strategy, each tenant gets its own database
+	(DBSuffix), else its own set of collections (CollSuffix).
+
+	Headers and hosts are whatever the client sends, so header
+	and subdomain sources must only be used behind a trusted
+	proxy (or gateway) that sets them after authenticating the
+	request. The jwt source reads a verified token
+*/
+
+const tenantKey = "do.tenant"
+const tenantMongoKey = "do.tenant.mongo"
+
+var tenantRex = regexp.MustCompile(`^[a-zA-Z0-9_]{1,64}$`)
+
+type TenantResolver func(c echo.Context) (string, error)
+
+// Builds the resolver configured under database.mongo.tenancy
+func NewTenantResolver() TenantResolver {
+	source := fig.StringOr("jwt", "database.mongo.tenancy.source")
+	switch source {
+	case "jwt":
+		return TenantFromJwtClaim(
+			fig.StringOr("user", "database.mongo.tenancy.context"),
+			fig.StringOr("tenant", "database.mongo.tenancy.claim"),
+		)
+	case "header":
+		return TenantFromHeader(fig.StringOr("X-Tenant", "database.mongo.tenancy.header"))
+	case "subdomain":
+		return TenantFromSubdomain
+	default:
+		panic("unknown tenancy source: " + source)
+	}
+}
+
+// Trusts the header as sent, see MULTI TENANCY above
+func TenantFromHeader(header string) TenantResolver {
+	return func(c echo.Context) (string, error) {
+		return validTenant(c.Request().Header.Get(header))
+	}
+}
+
+// acme.example.com gives acme. Trusts the host as sent, see
+// MULTI TENANCY above
+func TenantFromSubdomain(c echo.Context) (string, error) {
+	host := c.Request().Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	parts := strings.Split(host, ".")
+	if len(parts) < 3 {
+		return "", errors.New("no tenant subdomain")
+	}
+	return validTenant(parts[0])
+}
+
+// Reads a claim of the token, that a jwt middleware (which
+// verifies it) has stored in the context. The token may be
+// the claims map itself, or have a Claims field holding one
+func TenantFromJwtClaim(contextKey, claim string) TenantResolver {
+	return func(c echo.Context) (string, error) {
+		claims := jwtClaims(c.Get(contextKey))
+		if claims == nil {
+			return "", errors.New("no jwt claims")
+		}
+		tenant, _ := claims[claim].(string)
+		return validTenant(tenant)
+	}
+}
+
+func jwtClaims(token interface{}) map[string]interface{} {
+	if token == nil {
+		return nil
+	}
+
+	v := reflect.ValueOf(token)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() == reflect.Struct {
+		v = v.FieldByName("Claims")
+		if !v.IsValid() {
+			return nil
+		}
+		if v.Kind() == reflect.Interface {
+			v = v.Elem()
+		}
+	}
+
+	mapType := reflect.TypeOf(map[string]interface{}{})
+	if v.IsValid() && v.Kind() == reflect.Map && v.Type().ConvertibleTo(mapType) {
+		return v.Convert(mapType).Interface().(map[string]interface{})
+	}
+	return nil
+}
+
+// Tenant goes into database / collection names, so only
+// a safe set of characters is allowed
+func validTenant(tenant string) (string, error) {
+	tenant = strings.TrimSpace(tenant)
+	if tenant == "" {
+		return "", errors.New("no tenant")
+	}
+	if !tenantRex.MatchString(tenant) {
+		return "", errors.New("invalid tenant: " + tenant)
+	}
+	return tenant, nil
+}
+
+// MongoConnect scoped to a tenant, as per the configured strategy
+func NewMongoConnectForTenant(tenant string) *MongoConnect {
+	mc := NewMongoConnect()
+	if fig.StringOr("database", "database.mongo.tenancy.strategy") == "collection" {
+		mc.CollSuffix = tenant
+	} else {
+		mc.DBSuffix = tenant
+	}
+	return mc
+}
+
+// Resolves the tenant of every request, and stores a tenant
+// scoped MongoConnect in the context (see TenantMongo)
+func TenantMiddleware(resolve TenantResolver) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			tenant, err := resolve(c)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+
+			mc := NewMongoConnectForTenant(tenant)
+			defer mc.CloseClient()
+
+			c.Set(tenantKey, tenant)
+			c.Set(tenantMongoKey, mc)
+			return next(c)
+		}
+	}
+}
+
+// Tenant of the request (empty if not resolved)
+func Tenant(c echo.Context) string {
+	tenant, _ := c.Get(tenantKey).(string)
+	return tenant
+}
+
+// Tenant scoped MongoConnect of the request. Falls back to
+// the default MongoConnect when the middleware is not in use
+func TenantMongo(c echo.Context) *MongoConnect {
+	if mc, ok := c.Get(tenantMongoKey).(*MongoConnect); ok {
+		return mc
+	}
+	return NewMongoConnect()
+}
+
+// Creates the indexes of given models for a (new) tenant
+func ProvisionTenant(tenant string, models ...interface{}) ([]MongoIndex, error) {
+	if _, err := validTenant(tenant); err != nil {
+		return nil, err
+	}
+
+	mc := NewMongoConnectForTenant(tenant)
+	defer mc.CloseClient()
+
+	return mc.EnsureIndexes(models...)
+}
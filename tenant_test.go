@@ -0,0 +1,70 @@
+package do
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTenantResolvers(t *testing.T) {
+
+	e := echo.New()
+
+	// Header
+	{
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Tenant", "acme")
+		tenant, err := TenantFromHeader("X-Tenant")(e.NewContext(req, httptest.NewRecorder()))
+		assert.Nil(t, err)
+		assert.Equal(t, "acme", tenant)
+	}
+
+	// Subdomain
+	{
+		req := httptest.NewRequest("GET", "http://acme.example.com:8080/", nil)
+		tenant, err := TenantFromSubdomain(e.NewContext(req, httptest.NewRecorder()))
+		assert.Nil(t, err)
+		assert.Equal(t, "acme", tenant)
+
+		req = httptest.NewRequest("GET", "http://example.com/", nil)
+		_, err = TenantFromSubdomain(e.NewContext(req, httptest.NewRecorder()))
+		assert.NotNil(t, err)
+	}
+
+	// Jwt claims, as stored by a jwt middleware
+	{
+		type token struct {
+			Claims interface{}
+		}
+		c := e.NewContext(httptest.NewRequest("GET", "/", nil), httptest.NewRecorder())
+		c.Set("user", &token{Claims: map[string]interface{}{"tenant": "acme"}})
+		tenant, err := TenantFromJwtClaim("user", "tenant")(c)
+		assert.Nil(t, err)
+		assert.Equal(t, "acme", tenant)
+	}
+
+	// By default the (verified) jwt claim is read, and
+	// headers are not trusted
+	{
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Tenant", "acme")
+		c := e.NewContext(req, httptest.NewRecorder())
+		_, err := NewTenantResolver()(c)
+		assert.NotNil(t, err)
+
+		c.Set("user", map[string]interface{}{"tenant": "beta"})
+		tenant, err := NewTenantResolver()(c)
+		assert.Nil(t, err)
+		assert.Equal(t, "beta", tenant)
+	}
+
+	// Unsafe names are refused
+	{
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Tenant", "../admin")
+		_, err := TenantFromHeader("X-Tenant")(e.NewContext(req, httptest.NewRecorder()))
+		assert.NotNil(t, err)
+	}
+}
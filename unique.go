@@ -3,6 +3,7 @@ package do
 import (
 	"math/rand"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -24,7 +25,9 @@ func NewAlhpaNum(len int) string {
 	return randStringBytesMaskImprSrcSB(len)
 }
 
+// Sources are not safe for concurrent use
 var randStringSrc = rand.NewSource(time.Now().UnixNano())
+var randStringMu sync.Mutex
 
 const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 const (
@@ -35,6 +38,9 @@ const (
 
 // https://stackoverflow.com/questions/22892120/how-to-generate-a-random-string-of-a-fixed-length-in-go
 func randStringBytesMaskImprSrcSB(n int) string {
+	randStringMu.Lock()
+	defer randStringMu.Unlock()
+
 	sb := strings.Builder{}
 	sb.Grow(n)
 	// A src.Int63() generates 63 random bits, enough for letterIdxMax characters!